@@ -0,0 +1,372 @@
+package couchbase
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocb"
+)
+
+// Assert interface implementation
+var _ bucket = (*breakerBucket)(nil)
+
+// Service is a cluster service guarded by its own circuit breaker.
+type Service string
+
+const (
+	ServiceKV    Service = "kv"
+	ServiceQuery Service = "n1ql"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// CircuitOpenError is returned without reaching the cluster while the breaker of a service is open.
+type CircuitOpenError struct {
+	Service Service
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("couchbase: circuit breaker for %s is open", e.Service)
+}
+
+// BreakerSettings configures a CircuitBreaker.
+type BreakerSettings struct {
+	// Window is the number of most recent operations the failure ratio is computed over.
+	// Defaults to 20.
+	Window int
+	// MinRequests is the number of operations the window must hold before the breaker may open.
+	// Defaults to half the window, and is capped by it.
+	MinRequests int
+	// FailureRatio opens the breaker when reached by the failed operations of the window, within
+	// (0, 1]. Defaults to 0.5.
+	FailureRatio float64
+	// OpenTimeout is how long the breaker stays open before letting probes through. Defaults to
+	// 10 seconds.
+	OpenTimeout time.Duration
+	// Probes is the number of successful probes closing a half-open breaker. Defaults to 1.
+	Probes int
+}
+
+// CircuitBreaker fast-fails the operations of a degraded service. Only failures pointing at the
+// cluster's health count: timeouts, network errors and overload, not missing keys or conflicts.
+type CircuitBreaker struct {
+	settings BreakerSettings
+
+	locker   sync.Mutex
+	state    BreakerState
+	outcomes []bool
+	next     int
+	count    int
+	failures int
+	openedAt time.Time
+	round    int
+	probing  int
+	probed   int
+}
+
+// admission is an operation let through by a breaker. Probes are counted in the half-open round
+// they were let through in only.
+type admission struct {
+	probe bool
+	round int
+}
+
+func NewCircuitBreaker(settings BreakerSettings) *CircuitBreaker {
+	if settings.Window < 1 {
+		settings.Window = 20
+	}
+	if settings.MinRequests < 1 {
+		settings.MinRequests = (settings.Window + 1) / 2
+	} else if settings.MinRequests > settings.Window {
+		settings.MinRequests = settings.Window
+	}
+	if settings.FailureRatio <= 0 || settings.FailureRatio > 1 {
+		settings.FailureRatio = 0.5
+	}
+	if settings.OpenTimeout <= 0 {
+		settings.OpenTimeout = 10 * time.Second
+	}
+	if settings.Probes < 1 {
+		settings.Probes = 1
+	}
+	return &CircuitBreaker{
+		settings: settings,
+		outcomes: make([]bool, settings.Window),
+	}
+}
+
+// State returns the current state of the breaker, e.g. for health endpoints.
+func (b *CircuitBreaker) State() BreakerState {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.expire()
+	return b.state
+}
+
+// expire half-opens an open breaker once its timeout elapsed.
+func (b *CircuitBreaker) expire() {
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.settings.OpenTimeout {
+		b.state = BreakerHalfOpen
+		b.round++
+		b.probing = 0
+		b.probed = 0
+	}
+}
+
+// allow reports whether an operation may reach the service. Every allowed operation must be
+// followed by a call to done with the admission returned.
+func (b *CircuitBreaker) allow() (admission, bool) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	b.expire()
+	switch b.state {
+	case BreakerOpen:
+		return admission{}, false
+	case BreakerHalfOpen:
+		if b.probing+b.probed >= b.settings.Probes {
+			return admission{}, false
+		}
+		b.probing++
+		return admission{probe: true, round: b.round}, true
+	}
+	return admission{}, true
+}
+
+// done records the outcome of an allowed request made of total operations. Requests let through
+// while the breaker was closed are ignored once it opened, as are probes of a past round.
+func (b *CircuitBreaker) done(a admission, failures, total int) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	switch {
+	case a.probe:
+		if b.state != BreakerHalfOpen || a.round != b.round {
+			return
+		}
+		b.probing--
+		if failures > 0 {
+			b.open()
+		} else if b.probed++; b.probed >= b.settings.Probes {
+			b.reset()
+		}
+	case b.state == BreakerClosed:
+		for i := 0; i < total; i++ {
+			b.record(i < failures)
+		}
+		if b.failures > 0 && b.count >= b.settings.MinRequests && float64(b.failures) >= b.settings.FailureRatio*float64(b.count) {
+			b.open()
+		}
+	}
+}
+
+func (b *CircuitBreaker) record(failed bool) {
+	if b.count == len(b.outcomes) {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+	} else {
+		b.count++
+	}
+	if b.outcomes[b.next] = failed; failed {
+		b.failures++
+	}
+	b.next = (b.next + 1) % len(b.outcomes)
+}
+
+func (b *CircuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+}
+
+func (b *CircuitBreaker) reset() {
+	b.state = BreakerClosed
+	b.outcomes = make([]bool, len(b.outcomes))
+	b.next = 0
+	b.count = 0
+	b.failures = 0
+}
+
+// isServiceFailure reports whether err points at a degraded cluster.
+func isServiceFailure(err error) bool {
+	switch err {
+	case gocb.ErrTimeout, gocb.ErrNetwork, gocb.ErrOverload, gocb.ErrBusy, gocb.ErrOutOfMemory:
+		return true
+	}
+	return false
+}
+
+// SetCircuitBreaker guards the operations the store sends to service with b.
+// Passing nil removes the breaker of the service.
+func (c *CouchbaseStore) SetCircuitBreaker(service Service, b *CircuitBreaker) {
+	// The map is copied, as views share it with the store they come from.
+	breakers := make(map[Service]*CircuitBreaker, len(c.breakers)+1)
+	for s, breaker := range c.breakers {
+		breakers[s] = breaker
+	}
+	if b == nil {
+		delete(breakers, service)
+	} else {
+		breakers[service] = b
+	}
+	c.breakers = breakers
+	c.compose()
+}
+
+// CircuitBreaker returns the breaker guarding service, nil if there is none.
+func (c *CouchbaseStore) CircuitBreaker(service Service) *CircuitBreaker {
+	return c.breakers[service]
+}
+
+type breakerBucket struct {
+	bucket
+	kv    *CircuitBreaker
+	query *CircuitBreaker
+}
+
+func (b *breakerBucket) guard(fn func() error) error {
+	if b.kv == nil {
+		return fn()
+	}
+	a, ok := b.kv.allow()
+	if !ok {
+		return CircuitOpenError{Service: ServiceKV}
+	}
+	err := fn()
+	if isServiceFailure(err) {
+		b.kv.done(a, 1, 1)
+	} else {
+		b.kv.done(a, 0, 1)
+	}
+	return err
+}
+
+func (b *breakerBucket) Get(key string, valuePtr interface{}) (cas gocb.Cas, err error) {
+	err = b.guard(func() error {
+		cas, err = b.bucket.Get(key, valuePtr)
+		return err
+	})
+	return
+}
+func (b *breakerBucket) GetAndLock(key string, lockTime uint32, valuePtr interface{}) (cas gocb.Cas, err error) {
+	err = b.guard(func() error {
+		cas, err = b.bucket.GetAndLock(key, lockTime, valuePtr)
+		return err
+	})
+	return
+}
+func (b *breakerBucket) Unlock(key string, cas gocb.Cas) (out gocb.Cas, err error) {
+	err = b.guard(func() error {
+		out, err = b.bucket.Unlock(key, cas)
+		return err
+	})
+	return
+}
+func (b *breakerBucket) Touch(key string, cas gocb.Cas, expiry uint32) (out gocb.Cas, err error) {
+	err = b.guard(func() error {
+		out, err = b.bucket.Touch(key, cas, expiry)
+		return err
+	})
+	return
+}
+func (b *breakerBucket) Insert(key string, value interface{}, expiry uint32) (cas gocb.Cas, err error) {
+	err = b.guard(func() error {
+		cas, err = b.bucket.Insert(key, value, expiry)
+		return err
+	})
+	return
+}
+func (b *breakerBucket) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (out gocb.Cas, err error) {
+	err = b.guard(func() error {
+		out, err = b.bucket.Replace(key, value, cas, expiry)
+		return err
+	})
+	return
+}
+func (b *breakerBucket) Remove(key string, cas gocb.Cas) (out gocb.Cas, err error) {
+	err = b.guard(func() error {
+		out, err = b.bucket.Remove(key, cas)
+		return err
+	})
+	return
+}
+func (b *breakerBucket) Counter(key string, delta, initial int64, expiry uint32) (value uint64, cas gocb.Cas, err error) {
+	err = b.guard(func() error {
+		value, cas, err = b.bucket.Counter(key, delta, initial, expiry)
+		return err
+	})
+	return
+}
+
+func (b *breakerBucket) Expiry(key string) (expiry uint32, cas gocb.Cas, err error) {
+	err = b.guard(func() error {
+		expiry, cas, err = b.bucket.Expiry(key)
+		return err
+	})
+	return
+}
+
+// Do lets the batch through as a single request, every op of it counting towards the failure ratio.
+func (b *breakerBucket) Do(ops []gocb.BulkOp) error {
+	if b.kv == nil {
+		return b.bucket.Do(ops)
+	}
+	a, ok := b.kv.allow()
+	if !ok {
+		for _, op := range ops {
+			setBulkOpResult(op, 0, CircuitOpenError{Service: ServiceKV})
+		}
+		return nil
+	}
+
+	err := b.bucket.Do(ops)
+
+	failures := 0
+	for _, op := range ops {
+		if _, opErr := bulkOpResult(op); isServiceFailure(opErr) {
+			failures++
+		}
+	}
+	if isServiceFailure(err) {
+		failures = len(ops)
+	}
+	b.kv.done(a, failures, len(ops))
+
+	return err
+}
+
+func (b *breakerBucket) ExecuteN1qlQuery(q *gocb.N1qlQuery, params interface{}) (gocb.QueryResults, error) {
+	if b.query == nil {
+		return b.bucket.ExecuteN1qlQuery(q, params)
+	}
+	a, ok := b.query.allow()
+	if !ok {
+		return nil, CircuitOpenError{Service: ServiceQuery}
+	}
+	results, err := b.bucket.ExecuteN1qlQuery(q, params)
+	if isServiceFailure(err) {
+		b.query.done(a, 1, 1)
+	} else {
+		b.query.done(a, 0, 1)
+	}
+	return results, err
+}
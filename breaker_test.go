@@ -0,0 +1,122 @@
+package couchbase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+func TestCouchbaseStore_SetCircuitBreaker(t *testing.T) {
+	faults := NewFaultInjector(1, Fault{Ops: []Operation{OpGet}, Err: gocb.ErrTimeout})
+	breaker := NewCircuitBreaker(BreakerSettings{
+		Window:       4,
+		MinRequests:  4,
+		FailureRatio: 0.5,
+		OpenTimeout:  10 * time.Millisecond,
+	})
+
+	store := newStore(newFakeBucket())
+	store.InjectFaults(faults)
+	store.SetCircuitBreaker(ServiceKV, breaker)
+
+	// Missing keys don't count as failures.
+	for i := 0; i < 4; i++ {
+		store.DestroyOne("missing")
+	}
+	if s := store.CircuitBreaker(ServiceKV).State(); s != BreakerClosed {
+		t.Fatalf("Expected breaker to be closed. got %s.", s)
+	}
+
+	for i := 0; i < 2; i++ {
+		if row := store.ReadOne("key"); row.IsFaulted() {
+			if _, ok := row.Fault().(database.TimeoutError); !ok {
+				t.Fatalf("Expected TimeoutError. got %+v.", row.Fault())
+			}
+		}
+	}
+	if s := breaker.State(); s != BreakerOpen {
+		t.Fatalf("Expected breaker to be open. got %s.", s)
+	}
+
+	faults.Clear()
+	if row := store.ReadOne("key"); !row.IsFaulted() {
+		t.Fatal("Expected CircuitOpenError. got nil.")
+	} else if _, ok := row.Fault().(CircuitOpenError); !ok {
+		t.Fatalf("Expected CircuitOpenError. got %+v.", row.Fault())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if s := breaker.State(); s != BreakerHalfOpen {
+		t.Fatalf("Expected breaker to be half-open. got %s.", s)
+	}
+	if row := store.ReadOne("key"); row.IsFaulted() {
+		if _, ok := row.Fault().(database.NotFoundError); !ok {
+			t.Fatalf("Expected NotFoundError. got %+v.", row.Fault())
+		}
+	}
+	if s := breaker.State(); s != BreakerClosed {
+		t.Fatalf("Expected breaker to be closed. got %s.", s)
+	}
+
+	// Breakers set on a view leave the store untouched.
+	view := store.WithContext(context.Background())
+	view.SetCircuitBreaker(ServiceQuery, NewCircuitBreaker(BreakerSettings{}))
+	view.SetCircuitBreaker(ServiceKV, nil)
+	if store.CircuitBreaker(ServiceQuery) != nil || store.CircuitBreaker(ServiceKV) != breaker {
+		t.Error("Expected the breakers of the store to be untouched.")
+	}
+}
+
+func TestNewCircuitBreaker_Defaults(t *testing.T) {
+	breaker := NewCircuitBreaker(BreakerSettings{})
+
+	// Successful operations never open the breaker.
+	for i := 0; i < 40; i++ {
+		a, ok := breaker.allow()
+		if !ok {
+			t.Fatalf("Expected operation %d to be allowed.", i)
+		}
+		breaker.done(a, 0, 1)
+	}
+	if s := breaker.State(); s != BreakerClosed {
+		t.Fatalf("Expected breaker to be closed. got %s.", s)
+	}
+
+	for i := 0; i < 20; i++ {
+		a, _ := breaker.allow()
+		breaker.done(a, 1, 1)
+	}
+	if s := breaker.State(); s != BreakerOpen {
+		t.Fatalf("Expected breaker to be open. got %s.", s)
+	}
+}
+
+func TestCircuitBreaker_Probes(t *testing.T) {
+	breaker := NewCircuitBreaker(BreakerSettings{Window: 2, MinRequests: 2, OpenTimeout: time.Millisecond})
+
+	// An operation let through while closed finishes once the breaker is half-open.
+	late, _ := breaker.allow()
+	for i := 0; i < 2; i++ {
+		a, _ := breaker.allow()
+		breaker.done(a, 1, 1)
+	}
+	time.Sleep(2 * time.Millisecond)
+	probe, ok := breaker.allow()
+	if !ok {
+		t.Fatal("Expected a probe to be allowed.")
+	}
+	breaker.done(late, 0, 1)
+	if _, ok := breaker.allow(); ok {
+		t.Error("Expected a single probe to be allowed.")
+	}
+	if s := breaker.State(); s != BreakerHalfOpen {
+		t.Fatalf("Expected breaker to be half-open. got %s.", s)
+	}
+	breaker.done(probe, 0, 1)
+	if s := breaker.State(); s != BreakerClosed {
+		t.Fatalf("Expected breaker to be closed. got %s.", s)
+	}
+}
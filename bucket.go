@@ -0,0 +1,145 @@
+package couchbase
+
+import (
+	"github.com/couchbase/gocb"
+)
+
+// Assert interface implementation
+var _ bucket = gocbBucket{}
+
+// Operation names a single request sent to the cluster.
+type Operation string
+
+const (
+	OpGet        Operation = "get"
+	OpGetAndLock Operation = "getAndLock"
+	OpUnlock     Operation = "unlock"
+	OpTouch      Operation = "touch"
+	OpInsert     Operation = "insert"
+	OpReplace    Operation = "replace"
+	OpUpsert     Operation = "upsert"
+	OpRemove     Operation = "remove"
+	OpCounter    Operation = "counter"
+	OpExpiry     Operation = "expiry"
+	OpBulk       Operation = "bulk"
+	OpQuery      Operation = "n1ql"
+)
+
+// bucket is the subset of *gocb.Bucket used by CouchbaseStore. Wrappers implementing it
+// can observe or replace the traffic between the store and the cluster.
+type bucket interface {
+	Get(key string, valuePtr interface{}) (gocb.Cas, error)
+	GetAndLock(key string, lockTime uint32, valuePtr interface{}) (gocb.Cas, error)
+	Unlock(key string, cas gocb.Cas) (gocb.Cas, error)
+	Touch(key string, cas gocb.Cas, expiry uint32) (gocb.Cas, error)
+	Insert(key string, value interface{}, expiry uint32) (gocb.Cas, error)
+	Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error)
+	Remove(key string, cas gocb.Cas) (gocb.Cas, error)
+	Counter(key string, delta, initial int64, expiry uint32) (uint64, gocb.Cas, error)
+	// Expiry returns the expiry of the document at key, as a Unix time, zero when it has none.
+	Expiry(key string) (uint32, gocb.Cas, error)
+	Do(ops []gocb.BulkOp) error
+	ExecuteN1qlQuery(q *gocb.N1qlQuery, params interface{}) (gocb.QueryResults, error)
+	SetTranscoder(t gocb.Transcoder)
+	Close() error
+}
+
+// gocbBucket adds to *gocb.Bucket the operations of bucket it lacks.
+type gocbBucket struct {
+	*gocb.Bucket
+}
+
+// expiryPath is the virtual extended attribute holding the expiry of a document.
+const expiryPath = "$document.exptime"
+
+func (b gocbBucket) Expiry(key string) (uint32, gocb.Cas, error) {
+	frag, err := b.LookupInEx(key, gocb.SubdocDocFlagNone).GetEx(expiryPath, gocb.SubdocFlagXattr).Execute()
+	if err != nil {
+		return 0, 0, err
+	}
+	var expiry uint32
+	if err := frag.Content(expiryPath, &expiry); err != nil {
+		return 0, 0, err
+	}
+	return expiry, frag.Cas(), nil
+}
+
+// bulkOpKey returns the operation and key of a bulk op.
+func bulkOpKey(op gocb.BulkOp) (Operation, string) {
+	switch o := op.(type) {
+	case *gocb.GetOp:
+		return OpGet, o.Key
+	case *gocb.TouchOp:
+		return OpTouch, o.Key
+	case *gocb.InsertOp:
+		return OpInsert, o.Key
+	case *gocb.ReplaceOp:
+		return OpReplace, o.Key
+	case *gocb.UpsertOp:
+		return OpUpsert, o.Key
+	case *gocb.RemoveOp:
+		return OpRemove, o.Key
+	}
+	return "", ""
+}
+
+// bulkOpValue returns the value written by a bulk op, nil for ops writing none.
+func bulkOpValue(op gocb.BulkOp) interface{} {
+	switch o := op.(type) {
+	case *gocb.InsertOp:
+		return o.Value
+	case *gocb.ReplaceOp:
+		return o.Value
+	case *gocb.UpsertOp:
+		return o.Value
+	}
+	return nil
+}
+
+// bulkOpResult returns the cas and error reported for a bulk op.
+func bulkOpResult(op gocb.BulkOp) (gocb.Cas, error) {
+	switch o := op.(type) {
+	case *gocb.GetOp:
+		return o.Cas, o.Err
+	case *gocb.TouchOp:
+		return o.Cas, o.Err
+	case *gocb.InsertOp:
+		return o.Cas, o.Err
+	case *gocb.ReplaceOp:
+		return o.Cas, o.Err
+	case *gocb.UpsertOp:
+		return o.Cas, o.Err
+	case *gocb.RemoveOp:
+		return o.Cas, o.Err
+	}
+	return 0, nil
+}
+
+// setBulkOpResult sets the cas and error reported for a bulk op.
+func setBulkOpResult(op gocb.BulkOp, cas gocb.Cas, err error) {
+	switch o := op.(type) {
+	case *gocb.GetOp:
+		o.Cas, o.Err = cas, err
+	case *gocb.TouchOp:
+		o.Cas, o.Err = cas, err
+	case *gocb.InsertOp:
+		o.Cas, o.Err = cas, err
+	case *gocb.ReplaceOp:
+		o.Cas, o.Err = cas, err
+	case *gocb.UpsertOp:
+		o.Cas, o.Err = cas, err
+	case *gocb.RemoveOp:
+		o.Cas, o.Err = cas, err
+	}
+}
+
+// sendable returns the ops of a batch, leaving out the nil ops of rows faulted before sending it.
+func sendable(ops []gocb.BulkOp) []gocb.BulkOp {
+	out := make([]gocb.BulkOp, 0, len(ops))
+	for _, op := range ops {
+		if op != nil {
+			out = append(out, op)
+		}
+	}
+	return out
+}
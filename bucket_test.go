@@ -0,0 +1,215 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/couchbase/gocb"
+)
+
+type fakeItem struct {
+	value  []byte
+	flags  uint32
+	cas    gocb.Cas
+	expiry uint32
+	locked bool
+}
+
+// fakeBucket is an in-memory bucket following the server's CAS and lock semantics: a locked
+// document can only be changed with the cas returned by GetAndLock, and is reported as
+// ErrTmpFail to reads and removals and as ErrKeyExists to replacements.
+type fakeBucket struct {
+	locker     sync.Mutex
+	items      map[string]*fakeItem
+	cas        gocb.Cas
+	rows       []json.RawMessage
+	query      func(params interface{}) []json.RawMessage
+	transcoder gocb.Transcoder
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{items: map[string]*fakeItem{}, transcoder: transcoder{}}
+}
+
+func (f *fakeBucket) SetTranscoder(t gocb.Transcoder) {
+	f.transcoder = t
+}
+
+func (f *fakeBucket) nextCas() gocb.Cas {
+	f.cas++
+	return f.cas
+}
+
+func (f *fakeBucket) Get(key string, valuePtr interface{}) (gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	item := f.items[key]
+	if item == nil {
+		return 0, gocb.ErrKeyNotFound
+	}
+	return item.cas, f.transcoder.Decode(item.value, item.flags, valuePtr)
+}
+func (f *fakeBucket) GetAndLock(key string, lockTime uint32, valuePtr interface{}) (gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	item := f.items[key]
+	if item == nil {
+		return 0, gocb.ErrKeyNotFound
+	} else if item.locked {
+		return 0, gocb.ErrTmpFail
+	}
+	item.locked = true
+	item.cas = f.nextCas()
+	return item.cas, f.transcoder.Decode(item.value, item.flags, valuePtr)
+}
+func (f *fakeBucket) Unlock(key string, cas gocb.Cas) (gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	item := f.items[key]
+	if item == nil {
+		return 0, gocb.ErrKeyNotFound
+	} else if !item.locked || item.cas != cas {
+		return 0, gocb.ErrTmpFail
+	}
+	item.locked = false
+	return item.cas, nil
+}
+func (f *fakeBucket) Touch(key string, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	item, err := f.mutable(key, cas, gocb.ErrTmpFail)
+	if err != nil {
+		return 0, err
+	}
+	item.cas = f.nextCas()
+	item.expiry = expiry
+	return item.cas, nil
+}
+func (f *fakeBucket) Insert(key string, value interface{}, expiry uint32) (gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if f.items[key] != nil {
+		return 0, gocb.ErrKeyExists
+	}
+	data, flags, err := f.transcoder.Encode(value)
+	if err != nil {
+		return 0, err
+	}
+	item := &fakeItem{value: data, flags: flags, cas: f.nextCas(), expiry: expiry}
+	f.items[key] = item
+	return item.cas, nil
+}
+func (f *fakeBucket) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	item, err := f.mutable(key, cas, gocb.ErrKeyExists)
+	if err != nil {
+		return 0, err
+	}
+	if item.value, item.flags, err = f.transcoder.Encode(value); err != nil {
+		return 0, err
+	}
+	item.locked = false
+	item.cas = f.nextCas()
+	item.expiry = expiry
+	return item.cas, nil
+}
+func (f *fakeBucket) Remove(key string, cas gocb.Cas) (gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	item, err := f.mutable(key, cas, gocb.ErrTmpFail)
+	if err != nil {
+		return 0, err
+	}
+	delete(f.items, key)
+	return item.cas, nil
+}
+
+func (f *fakeBucket) Counter(key string, delta, initial int64, expiry uint32) (uint64, gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	item := f.items[key]
+	if item == nil {
+		item = &fakeItem{value: []byte(strconv.FormatInt(initial, 10)), expiry: expiry}
+		f.items[key] = item
+	} else if item.locked {
+		return 0, 0, gocb.ErrTmpFail
+	} else {
+		value, err := strconv.ParseInt(string(item.value), 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		item.value = []byte(strconv.FormatInt(value+delta, 10))
+	}
+	item.cas = f.nextCas()
+	value, _ := strconv.ParseUint(string(item.value), 10, 64)
+	return value, item.cas, nil
+}
+
+func (f *fakeBucket) Expiry(key string) (uint32, gocb.Cas, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	item := f.items[key]
+	if item == nil {
+		return 0, 0, gocb.ErrKeyNotFound
+	}
+	return item.expiry, item.cas, nil
+}
+
+// mutable returns the item stored at key if it may be changed with cas.
+func (f *fakeBucket) mutable(key string, cas gocb.Cas, lockedErr error) (*fakeItem, error) {
+	item := f.items[key]
+	if item == nil {
+		return nil, gocb.ErrKeyNotFound
+	} else if item.locked && item.cas != cas {
+		return nil, lockedErr
+	} else if cas != 0 && item.cas != cas {
+		return nil, gocb.ErrKeyExists
+	}
+	return item, nil
+}
+
+func (f *fakeBucket) Do(ops []gocb.BulkOp) error {
+	for _, op := range ops {
+		switch o := op.(type) {
+		case *gocb.GetOp:
+			o.Cas, o.Err = f.Get(o.Key, o.Value)
+		case *gocb.TouchOp:
+			o.Cas, o.Err = f.Touch(o.Key, o.Cas, o.Expiry)
+		case *gocb.InsertOp:
+			o.Cas, o.Err = f.Insert(o.Key, o.Value, o.Expiry)
+		case *gocb.ReplaceOp:
+			o.Cas, o.Err = f.Replace(o.Key, o.Value, o.Cas, o.Expiry)
+		case *gocb.UpsertOp:
+			if f.items[o.Key] == nil {
+				o.Cas, o.Err = f.Insert(o.Key, o.Value, o.Expiry)
+			} else {
+				o.Cas, o.Err = f.Replace(o.Key, o.Value, o.Cas, o.Expiry)
+			}
+		case *gocb.RemoveOp:
+			o.Cas, o.Err = f.Remove(o.Key, o.Cas)
+		}
+	}
+	return nil
+}
+
+func (f *fakeBucket) ExecuteN1qlQuery(q *gocb.N1qlQuery, params interface{}) (gocb.QueryResults, error) {
+	if f.query != nil {
+		return &replayResults{rows: f.query(params)}, nil
+	}
+	return &replayResults{rows: f.rows}, nil
+}
+
+func (f *fakeBucket) Close() error {
+	return nil
+}
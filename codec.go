@@ -0,0 +1,296 @@
+package couchbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+// Assert interface implementation
+var (
+	_ Codec = EnvelopeCodec{}
+	_ Codec = FlatCodec{}
+	_ Codec = RawCodec{}
+)
+
+// Envelope is a document as seen by a Codec.
+type Envelope struct {
+	Id   string
+	Type string
+	// Data is the value stored by the document. When decoding, it is the value to decode into,
+	// or nil to keep the raw JSON bytes.
+	Data interface{}
+	Meta map[string]interface{}
+	// Version is the schema version of the data, zero when unversioned. See Migrations.
+	Version int
+}
+
+// Codec serializes documents for KV operations and decodes the documents returned by queries.
+type Codec interface {
+	Encode(e *Envelope) ([]byte, error)
+	Decode(data []byte, e *Envelope) error
+}
+
+// SetCodec serializes the documents of the store with codec. Passing nil restores EnvelopeCodec.
+// The documents returned by queries are decoded with codec and returned in the layout of
+// EnvelopeCodec, so results read the same whichever codec stores them. Documents stored by
+// RawCodec have no envelope and are returned as stored.
+func (c *CouchbaseStore) SetCodec(codec Codec) {
+	c.codec = codec
+}
+
+// baseCodec returns the codec storing the documents encoded by codec, beneath the codecs wrapping
+// another, such as CompressionCodec.
+func baseCodec(codec Codec) Codec {
+	for {
+		switch c := codec.(type) {
+		case CompressionCodec:
+			codec = c.codec()
+		case EncryptionCodec:
+			codec = c.codec()
+		default:
+			return codec
+		}
+	}
+}
+
+// resultCodec returns the codec decoding the documents returned by queries, nil when they are
+// returned as stored.
+func (c *CouchbaseStore) resultCodec() Codec {
+	switch c.codec.(type) {
+	case nil, EnvelopeCodec, RawCodec:
+		return nil
+	}
+	return c.codec
+}
+
+// DecodeRow decodes a document returned by a query, e.g. selected with `SELECT b.* FROM b`.
+// The data is decoded into out, kept as raw bytes when nil.
+func (c *CouchbaseStore) DecodeRow(data []byte, out interface{}) (database.Row, error) {
+	doc := c.newDoc("")
+	doc.Data = out
+	if c.resultCodec() != nil {
+		doc.codec = EnvelopeCodec{}
+	}
+	err := doc.UnmarshalJSON(data)
+	doc.codec = c.codec
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// encodeMeta returns a copy of meta holding only what is stored, with timestamps in nanoseconds.
+func encodeMeta(meta map[string]interface{}) map[string]interface{} {
+	cpy := make(map[string]interface{}, len(meta))
+	for k, v := range meta {
+		cpy[k] = v
+	}
+
+	for _, key := range []string{database.CREATEDON, database.UPDATEDON} {
+		switch value := cpy[key].(type) {
+		case time.Time:
+			cpy[key] = value.UnixNano()
+		case int64:
+			cpy[key] = value
+		default:
+			delete(cpy, key)
+		}
+	}
+	return cpy
+}
+
+// decodeMeta restores the timestamps of meta decoded with json.Number.
+func decodeMeta(meta map[string]interface{}) map[string]interface{} {
+	if meta == nil {
+		return map[string]interface{}{}
+	}
+	for _, key := range []string{database.CREATEDON, database.UPDATEDON} {
+		if value, ok := meta[key].(json.Number); ok {
+			if value, err := value.Int64(); err == nil {
+				meta[key] = time.Unix(0, value)
+			}
+		}
+	}
+	return meta
+}
+
+// decodeData decodes data into out, or returns the raw bytes when out is nil.
+func decodeData(data []byte, out interface{}) (interface{}, error) {
+	if out == nil {
+		return append([]byte(nil), data...), nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func newNumberDecoder(data []byte) *json.Decoder {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec
+}
+
+// EnvelopeCodec stores documents as {"_uId", "_type", "data", "meta"}. It is the default codec.
+type EnvelopeCodec struct{}
+
+type envelope struct {
+	Id      string                 `json:"_uId"`
+	Type    string                 `json:"_type"`
+	Version int                    `json:"_version,omitempty"`
+	Data    json.RawMessage        `json:"data"`
+	Meta    map[string]interface{} `json:"meta"`
+}
+
+func (EnvelopeCodec) Encode(e *Envelope) ([]byte, error) {
+	pre := envelope{
+		Id:      e.Id,
+		Type:    e.Type,
+		Version: e.Version,
+		Meta:    encodeMeta(e.Meta),
+	}
+
+	if data, err := json.Marshal(e.Data); err != nil {
+		return nil, err
+	} else {
+		pre.Data = data
+	}
+
+	return json.Marshal(&pre)
+}
+func (EnvelopeCodec) Decode(data []byte, e *Envelope) error {
+	pre := envelope{}
+	if err := newNumberDecoder(data).Decode(&pre); err != nil {
+		return err
+	}
+
+	e.Id = pre.Id
+	e.Type = pre.Type
+	e.Version = pre.Version
+	e.Meta = decodeMeta(pre.Meta)
+
+	if value, err := decodeData(pre.Data, e.Data); err != nil {
+		return err
+	} else {
+		e.Data = value
+	}
+	return nil
+}
+
+// FlatCodec stores the fields of the data at the top level of documents, alongside the
+// reserved "_uId", "_type", "_version" and "_meta" fields. The data must marshal to a JSON object.
+type FlatCodec struct{}
+
+const (
+	flatId      = "_uId"
+	flatType    = "_type"
+	flatVersion = "_version"
+	flatMeta    = "_meta"
+)
+
+func (FlatCodec) Encode(e *Envelope) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if e.Data != nil {
+		data, err := json.Marshal(e.Data)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, fmt.Errorf("couchbase: flat documents require object data: %v", err)
+		}
+	}
+
+	for _, reserved := range []string{flatId, flatType, flatVersion, flatMeta} {
+		if _, ok := fields[reserved]; ok {
+			return nil, fmt.Errorf("couchbase: data field %q is reserved", reserved)
+		}
+	}
+
+	var err error
+	if fields[flatId], err = json.Marshal(e.Id); err != nil {
+		return nil, err
+	}
+	if fields[flatType], err = json.Marshal(e.Type); err != nil {
+		return nil, err
+	}
+	if fields[flatMeta], err = json.Marshal(encodeMeta(e.Meta)); err != nil {
+		return nil, err
+	}
+	if e.Version != 0 {
+		if fields[flatVersion], err = json.Marshal(e.Version); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
+func (FlatCodec) Decode(data []byte, e *Envelope) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var id, typ string
+	var version int
+	var meta map[string]interface{}
+	if raw, ok := fields[flatId]; ok {
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return err
+		}
+	}
+	if raw, ok := fields[flatType]; ok {
+		if err := json.Unmarshal(raw, &typ); err != nil {
+			return err
+		}
+	}
+	if raw, ok := fields[flatVersion]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return err
+		}
+	}
+	if raw, ok := fields[flatMeta]; ok {
+		if err := newNumberDecoder(raw).Decode(&meta); err != nil {
+			return err
+		}
+	}
+	delete(fields, flatId)
+	delete(fields, flatType)
+	delete(fields, flatVersion)
+	delete(fields, flatMeta)
+
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	e.Id = id
+	e.Type = typ
+	e.Version = version
+	e.Meta = decodeMeta(meta)
+	if value, err := decodeData(rest, e.Data); err != nil {
+		return err
+	} else {
+		e.Data = value
+	}
+	return nil
+}
+
+// RawCodec stores the data as is, without an envelope. Id, type, version and metadata aren't stored:
+// decoded documents keep the id and type they were read with and have no metadata.
+type RawCodec struct{}
+
+func (RawCodec) Encode(e *Envelope) ([]byte, error) {
+	return json.Marshal(e.Data)
+}
+func (RawCodec) Decode(data []byte, e *Envelope) error {
+	e.Meta = map[string]interface{}{}
+	if value, err := decodeData(data, e.Data); err != nil {
+		return err
+	} else {
+		e.Data = value
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+func TestCodecs(t *testing.T) {
+	now := time.Unix(0, time.Now().UnixNano())
+
+	for name, codec := range map[string]Codec{
+		"envelope": EnvelopeCodec{},
+		"flat":     FlatCodec{},
+	} {
+		in := &Envelope{
+			Id:   "1",
+			Type: "user",
+			Data: &User{Username: "username", Password: "password"},
+			Meta: map[string]interface{}{database.CREATEDON: now, "origin": "test"},
+		}
+		data, err := codec.Encode(in)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		out := &Envelope{Data: &User{}}
+		if err := codec.Decode(data, out); err != nil {
+			t.Fatal(name, err)
+		}
+		if out.Id != "1" || out.Type != "user" {
+			t.Errorf("%s: expected id 1 and type user. got %s and %s.", name, out.Id, out.Type)
+		}
+		if u := out.Data.(*User); u.Username != "username" || u.Password != "password" {
+			t.Errorf("%s: expected data to round trip. got %+v.", name, u)
+		}
+		if ts, ok := out.Meta[database.CREATEDON].(time.Time); !ok || !ts.Equal(now) {
+			t.Errorf("%s: expected createdOn %v. got %v.", name, now, out.Meta[database.CREATEDON])
+		}
+		if out.Meta["origin"] != "test" {
+			t.Errorf("%s: expected meta to round trip. got %v.", name, out.Meta)
+		}
+		if _, ok := in.Meta[database.CREATEDON].(time.Time); !ok {
+			t.Errorf("%s: expected encoding to leave the meta untouched.", name)
+		}
+	}
+}
+
+func TestFlatCodec(t *testing.T) {
+	data, err := FlatCodec{}.Encode(&Envelope{Id: "1", Type: "user", Data: &User{Username: "username"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["username"] != "username" || fields["_uId"] != "1" || fields["_type"] != "user" {
+		t.Errorf("Expected data fields at the top level. got %s.", data)
+	}
+
+	if _, err := (FlatCodec{}).Encode(&Envelope{Data: map[string]string{"_type": "x"}}); err == nil {
+		t.Error("Expected reserved fields to be rejected.")
+	}
+	if _, err := (FlatCodec{}).Encode(&Envelope{Data: "string"}); err == nil {
+		t.Error("Expected non-object data to be rejected.")
+	}
+}
+
+func TestCouchbaseStore_SetCodec(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	store.SetCodec(RawCodec{})
+
+	d := store.NewRow("1")
+	d.SetType("user")
+	d.SetData(&User{Username: "username"})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+
+	if value := string(fake.items["user::1"].value); value != `{"username":"username","password":""}` {
+		t.Errorf("Expected the data to be stored without envelope. got %s.", value)
+	}
+
+	u := &User{}
+	if row := store.ReadOneWithType("user::1", u); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if u.Username != "username" {
+		t.Errorf("Expected username. got %s.", u.Username)
+	}
+
+	row, err := store.DecodeRow(fake.items["user::1"].value, &User{})
+	if err != nil {
+		t.Fatal(err)
+	} else if row.GetData().(*User).Username != "username" {
+		t.Errorf("Expected username. got %+v.", row.GetData())
+	}
+}
+
+func TestCouchbaseStore_Exec_Codec(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	store.SetCodec(FlatCodec{})
+
+	d := store.NewRow("1")
+	d.SetType("user")
+	d.SetData(&User{Username: "username"})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+
+	stored := fake.items["user::1"].value
+	fake.rows = []json.RawMessage{stored, json.RawMessage(`{"b":` + string(stored) + `}`), json.RawMessage(`{"$1":1}`), json.RawMessage(`{"_type":"user","n":3}`)}
+	results, err := store.Exec(store.NewQuery("SELECT b.* FROM b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents are returned in the layout of EnvelopeCodec, whole or under their alias.
+	var doc struct {
+		Data User `json:"data"`
+	}
+	if err := results.One(&doc); err != nil {
+		t.Fatal(err)
+	} else if doc.Data.Username != "username" {
+		t.Errorf("Expected the document in an envelope. got %+v.", doc)
+	}
+	var aliased struct {
+		B struct {
+			Data User `json:"data"`
+		} `json:"b"`
+	}
+	if err := results.One(&aliased); err != nil {
+		t.Fatal(err)
+	} else if aliased.B.Data.Username != "username" {
+		t.Errorf("Expected the aliased document in an envelope. got %+v.", aliased)
+	}
+	if b := string(results.OneBytes()); b != `{"$1":1}` {
+		t.Errorf("Expected other rows as is. got %s.", b)
+	}
+	if b := string(results.OneBytes()); b != `{"_type":"user","n":3}` {
+		t.Errorf("Expected aggregates grouped by type as is. got %s.", b)
+	}
+
+	// Rows decode with the codec of the store kept, to be written back.
+	results, _ = store.Exec(store.NewQuery("SELECT b.* FROM b"))
+	u := &User{}
+	row, err := store.DecodeRow(results.OneBytes(), u)
+	if err != nil {
+		t.Fatal(err)
+	} else if u.Username != "username" || row.GetId() != "1" {
+		t.Errorf("Expected user 1. got %+v and %s.", u, row.GetId())
+	}
+	u.Username = "changed"
+	if row := store.ReplaceOne(row); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if value := string(fake.items["user::1"].value); !strings.Contains(value, `"username":"changed"`) || strings.Contains(value, `"data"`) {
+		t.Errorf("Expected the document to be stored flat. got %s.", value)
+	}
+}
@@ -0,0 +1,195 @@
+package couchbase
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Assert interface implementation
+var _ Codec = CompressionCodec{}
+
+// COMPRESSION is the meta key flagging the algorithm compressing the data of a stored document.
+// It is set and removed by CompressionCodec and never seen by the rows of the store.
+const COMPRESSION = "compression"
+
+// Compression names a compression algorithm.
+type Compression string
+
+const (
+	Gzip   Compression = "gzip"
+	Snappy Compression = "snappy"
+	Zstd   Compression = "zstd"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+func (a Compression) compress(data []byte) ([]byte, error) {
+	switch a {
+	case Gzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Snappy:
+		return snappy.Encode(nil, data), nil
+	case Zstd:
+		enc, _ := zstdCoders()
+		return enc.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("couchbase: unknown compression %q", string(a))
+}
+
+func (a Compression) decompress(data []byte) ([]byte, error) {
+	switch a {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case Snappy:
+		return snappy.Decode(nil, data)
+	case Zstd:
+		_, dec := zstdCoders()
+		return dec.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("couchbase: unknown compression %q", string(a))
+}
+
+// errRawCompression faults the documents CompressionCodec encodes with RawCodec, which can't flag them.
+var errRawCompression = errors.New("couchbase: RawCodec can't store compressed documents")
+
+// errCompressedEncryption faults the documents CompressionCodec encodes with an EncryptionCodec,
+// which finds no field to encrypt in compressed data. The EncryptionCodec must wrap the
+// CompressionCodec instead.
+var errCompressedEncryption = errors.New("couchbase: CompressionCodec can't encode with EncryptionCodec, wrap it in EncryptionCodec instead")
+
+// compressed is the data of a compressed document. It is an object so FlatCodec can store it.
+type compressed struct {
+	Data []byte `json:"compressed"`
+}
+
+// CompressionCodec compresses the data of the documents whose serialized data exceeds Threshold
+// bytes before encoding them with Codec, flagging them with the COMPRESSION meta. Documents are
+// decompressed whichever algorithm compressed them. RawCodec doesn't store the flag: documents
+// encoded with it fail. So do documents encoded with an EncryptionCodec, see EncryptionCodec.
+type CompressionCodec struct {
+	// Codec encodes the documents. Defaults to EnvelopeCodec.
+	Codec Codec
+	// Algorithm compresses the data. Defaults to Gzip.
+	Algorithm Compression
+	// Threshold is the size of the serialized data above which it is compressed.
+	Threshold int
+	// Metrics observes the compression ratio of the documents, when set.
+	Metrics *Metrics
+}
+
+func (c CompressionCodec) codec() Codec {
+	if c.Codec == nil {
+		return EnvelopeCodec{}
+	}
+	return c.Codec
+}
+
+func (c CompressionCodec) algorithm() Compression {
+	if c.Algorithm == "" {
+		return Gzip
+	}
+	return c.Algorithm
+}
+
+func (c CompressionCodec) Encode(e *Envelope) ([]byte, error) {
+	if _, ok := baseCodec(c).(RawCodec); ok {
+		return nil, errRawCompression
+	}
+	for codec := c.codec(); codec != nil; {
+		switch inner := codec.(type) {
+		case EncryptionCodec:
+			return nil, errCompressedEncryption
+		case CompressionCodec:
+			codec = inner.codec()
+		default:
+			codec = nil
+		}
+	}
+
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= c.Threshold {
+		return c.codec().Encode(&Envelope{Id: e.Id, Type: e.Type, Data: json.RawMessage(data), Meta: e.Meta, Version: e.Version})
+	}
+
+	algorithm := c.algorithm()
+	packed, err := algorithm.compress(data)
+	if err != nil {
+		return nil, err
+	}
+	if c.Metrics != nil && len(packed) > 0 {
+		c.Metrics.ratio.WithLabelValues(string(algorithm)).Observe(float64(len(data)) / float64(len(packed)))
+	}
+
+	meta := make(map[string]interface{}, len(e.Meta)+1)
+	for k, v := range e.Meta {
+		meta[k] = v
+	}
+	meta[COMPRESSION] = string(algorithm)
+
+	return c.codec().Encode(&Envelope{Id: e.Id, Type: e.Type, Data: &compressed{packed}, Meta: meta, Version: e.Version})
+}
+
+func (c CompressionCodec) Decode(data []byte, e *Envelope) error {
+	out := e.Data
+	e.Data = nil
+	if err := c.codec().Decode(data, e); err != nil {
+		return err
+	}
+
+	raw, _ := e.Data.([]byte)
+	if algorithm, ok := e.Meta[COMPRESSION].(string); ok {
+		delete(e.Meta, COMPRESSION)
+
+		packed := compressed{}
+		if err := json.Unmarshal(raw, &packed); err != nil {
+			return err
+		}
+		var err error
+		if raw, err = Compression(algorithm).decompress(packed.Data); err != nil {
+			return err
+		}
+	}
+
+	if value, err := decodeData(raw, out); err != nil {
+		return err
+	} else {
+		e.Data = value
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCompressionCodec(t *testing.T) {
+	long := strings.Repeat("password", 256)
+
+	for _, algorithm := range []Compression{Gzip, Snappy, Zstd} {
+		m := NewMetrics("test")
+		codec := CompressionCodec{Codec: FlatCodec{}, Algorithm: algorithm, Threshold: 1024, Metrics: m}
+
+		data, err := codec.Encode(&Envelope{Id: "1", Type: "user", Data: &User{Username: "username", Password: long}})
+		if err != nil {
+			t.Fatal(algorithm, err)
+		}
+		if len(data) >= len(long) {
+			t.Errorf("%s: expected the data to be compressed. got %d bytes.", algorithm, len(data))
+		}
+
+		out := &Envelope{Data: &User{}}
+		if err := codec.Decode(data, out); err != nil {
+			t.Fatal(algorithm, err)
+		}
+		if u := out.Data.(*User); u.Username != "username" || u.Password != long {
+			t.Errorf("%s: expected data to round trip. got %q.", algorithm, u.Username)
+		}
+		if _, ok := out.Meta[COMPRESSION]; ok {
+			t.Errorf("%s: expected the compression flag to be removed. got %v.", algorithm, out.Meta)
+		}
+
+		ratio := gather(t, m)["test_compression_ratio"].GetMetric()[0].GetHistogram()
+		if ratio.GetSampleCount() != 1 || ratio.GetSampleSum() <= 1 {
+			t.Errorf("%s: expected a compression ratio above 1. got %v.", algorithm, ratio)
+		}
+	}
+}
+
+func TestCompressionCodec_Threshold(t *testing.T) {
+	codec := CompressionCodec{Threshold: 1024}
+
+	data, err := codec.Encode(&Envelope{Id: "1", Data: &User{Username: "username"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["meta"].(map[string]interface{})[COMPRESSION]; ok {
+		t.Errorf("Expected small documents not to be compressed. got %s.", data)
+	}
+
+	// Documents compressed with any algorithm are read back.
+	data, err = CompressionCodec{Algorithm: Zstd}.Encode(&Envelope{Id: "1", Data: &User{Username: "username"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &Envelope{}
+	if err := codec.Decode(data, out); err != nil {
+		t.Fatal(err)
+	} else if string(out.Data.([]byte)) != `{"username":"username","password":""}` {
+		t.Errorf("Expected the raw data. got %s.", out.Data)
+	}
+
+	// RawCodec can't flag compressed documents.
+	for _, codec := range []Codec{CompressionCodec{Codec: RawCodec{}}, CompressionCodec{Codec: CompressionCodec{Codec: RawCodec{}}}} {
+		if _, err := codec.Encode(&Envelope{Id: "1", Data: &User{Username: "username"}}); err != errRawCompression {
+			t.Errorf("Expected errRawCompression. got %v.", err)
+		}
+	}
+}
+
+func TestCouchbaseStore_Compression(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	store.SetCodec(CompressionCodec{Algorithm: Snappy, Threshold: 64})
+
+	d := store.NewRow("1")
+	d.SetType("user")
+	d.SetData(&User{Username: "username", Password: strings.Repeat("x", 512)})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if n := len(fake.items["user::1"].value); n >= 512 {
+		t.Errorf("Expected the stored document to be compressed. got %d bytes.", n)
+	}
+
+	u := &User{}
+	if row := store.ReadOneWithType("user::1", u); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if len(u.Password) != 512 {
+		t.Errorf("Expected the password to round trip. got %d bytes.", len(u.Password))
+	}
+
+	fake.rows = []json.RawMessage{fake.items["user::1"].value}
+	results, err := store.Exec(store.NewQuery("SELECT b.* FROM b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u = &User{}
+	row, err := store.DecodeRow(results.OneBytes(), u)
+	if err != nil {
+		t.Fatal(err)
+	} else if row.GetMeta(COMPRESSION) != nil {
+		t.Errorf("Expected the compression flag to be hidden. got %v.", row.GetMeta(COMPRESSION))
+	} else if len(u.Password) != 512 {
+		t.Errorf("Expected the password to be decompressed. got %d bytes.", len(u.Password))
+	}
+}
@@ -1,6 +1,7 @@
 package couchbase
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -8,7 +9,6 @@ import (
 
 	. "github.com/Tlantic/go-nosql"
 	"github.com/couchbase/gocb"
-	"github.com/twinj/uuid"
 )
 
 //noinspection GoUnusedGlobalVariable
@@ -18,17 +18,83 @@ var (
 
 var mu = sync.Mutex{}
 var clusters = map[string]*gocb.Cluster{}
+var openStores = 0
 
 // Assert interface implementation
 var _ Interface = (*CouchbaseStore)(nil)
 
 type CouchbaseStore struct {
-	name   string
-	bucket *gocb.Bucket
+	name       string
+	bucketName string
+	ctx        context.Context
+
+	conn      bucket
+	bucket    bucket
+	faults    *FaultInjector
+	breakers  map[Service]*CircuitBreaker
+	retry     *RetryPolicy
+	metrics   *Metrics
+	logging   *logging
+	codec     Codec
+	versions  *Migrations
+	validator func(data interface{}) error
+	keys      KeyStrategy
+	tenant    string
+
+	mutateAttempts int
+	softDelete     *SoftDelete
+	withDeleted    bool
+	wrapErrors     bool
+
+	middleware []Middleware
+	closed     bool
+	// isView is set on the copies returned by WithContext, ForTenant and WithDeleted.
+	isView bool
+}
+
+func newStore(conn bucket) *CouchbaseStore {
+	mu.Lock()
+	openStores++
+	l := defaultLogging
+	mu.Unlock()
+
+	conn.SetTranscoder(transcoder{})
+	c := &CouchbaseStore{name: "couchbase", conn: conn, logging: l}
+	c.compose()
+	return c
+}
+
+// compose rebuilds the bucket used by the store, layering the configured wrappers over the connection.
+func (c *CouchbaseStore) compose() {
+	var b bucket = c.conn
+	if c.faults != nil {
+		b = &faultyBucket{bucket: b, faults: c.faults}
+	}
+	if len(c.breakers) > 0 {
+		b = &breakerBucket{bucket: b, kv: c.breakers[ServiceKV], query: c.breakers[ServiceQuery]}
+	}
+	if c.retry != nil {
+		r := &retryingBucket{bucket: b, policy: c.retry, ctx: c.ctx}
+		if c.logging != nil {
+			r.onRetry = c.logging.retried
+		}
+		b = r
+	}
+	if c.metrics != nil {
+		b = &meteredBucket{bucket: b, metrics: c.metrics}
+	}
+	c.bucket = b
 }
 
 func makeCreateError(err error) (err2 error) {
 
+	if _, ok := err.(CircuitOpenError); ok {
+		return err
+	}
+	if err2 = makeCommonError(err); err2 != nil {
+		return
+	}
+
 	switch err {
 	case gocb.ErrKeyExists:
 		err2 = AlreadyExistsError{err}
@@ -37,7 +103,7 @@ func makeCreateError(err error) (err2 error) {
 	case gocb.ErrNotStored:
 		err2 = NotStoredError{err}
 	case gocb.ErrTmpFail:
-		err2 = TemporaryFailureError{err}
+		err2 = TemporaryFailureError{TemporaryError{err}}
 	case gocb.ErrTimeout:
 		err2 = TimeoutError{err}
 	default:
@@ -46,12 +112,33 @@ func makeCreateError(err error) (err2 error) {
 
 	return
 }
+
+// makeGetError maps the errors of plain reads, which locked documents don't fail: their temporary
+// failures come from the cluster, e.g. overloaded.
+func makeGetError(err error) error {
+	if err == gocb.ErrTmpFail {
+		return TemporaryFailureError{TemporaryError{err}}
+	}
+	return makeReadError(err)
+}
+
+// makeReadError maps the errors of operations on existing documents. The server reports locked
+// documents as temporary failures to them, and a stale cas as an existing key.
 func makeReadError(err error) (err2 error) {
 
+	if _, ok := err.(CircuitOpenError); ok {
+		return err
+	}
+	if err2 = makeCommonError(err); err2 != nil {
+		return
+	}
+
 	switch err {
-	case gocb.ErrTmpFail:
-		err2 = LockedError{err}
-	case gocb.ErrKeyNotFound:
+	case gocb.ErrTmpFail, errPending:
+		err2 = LockedError{DocumentLockedError{err}}
+	case gocb.ErrKeyExists:
+		err2 = LockedError{CASMismatchError{err}}
+	case gocb.ErrKeyNotFound, errOtherTenant, errStaged, errDeleted:
 		err2 = NotFoundError{err}
 	case gocb.ErrTimeout:
 		err2 = TimeoutError{err}
@@ -61,11 +148,27 @@ func makeReadError(err error) (err2 error) {
 
 	return
 }
-func makeMutationError(err error) (err2 error) {
+
+// makeMutationError maps the errors of replacements sent with cas. Without a cas, an existing
+// key means the document is locked.
+func makeMutationError(err error, cas gocb.Cas) (err2 error) {
+
+	if _, ok := err.(CircuitOpenError); ok {
+		return err
+	}
+	if err2 = makeCommonError(err); err2 != nil {
+		return
+	}
 
 	switch err {
 	case gocb.ErrKeyExists:
-		err2 = LockedError{err}
+		if cas == 0 {
+			err2 = LockedError{DocumentLockedError{err}}
+		} else {
+			err2 = LockedError{CASMismatchError{err}}
+		}
+	case gocb.ErrTmpFail:
+		err2 = TemporaryFailureError{TemporaryError{err}}
 	case gocb.ErrKeyNotFound:
 		err2 = NotFoundError{err}
 	case gocb.ErrTimeout:
@@ -77,8 +180,61 @@ func makeMutationError(err error) (err2 error) {
 	return
 }
 
-//noinspection ALL
-func NewCouchbaseStore(host, bucketName, bucketPassword string) (*CouchbaseStore, error) {
+// errorClass names the kind of a row fault or query error, e.g. "NotFoundError", or of its
+// cause when it tells it apart, e.g. "CASMismatchError".
+func errorClass(err error) string {
+	if w, ok := err.(wrappedError); ok {
+		err = w.err
+	}
+	switch Cause(err).(type) {
+	case CASMismatchError:
+		return "CASMismatchError"
+	case DocumentLockedError:
+		return "DocumentLockedError"
+	case TemporaryError:
+		return "TemporaryError"
+	case DurabilityAmbiguousError:
+		return "DurabilityAmbiguousError"
+	case AccessDeniedError:
+		return "AccessDeniedError"
+	case BucketNotFoundError:
+		return "BucketNotFoundError"
+	}
+
+	switch err.(type) {
+	case nil:
+		return ""
+	case AlreadyExistsError:
+		return "AlreadyExistsError"
+	case TooBigError:
+		return "TooBigError"
+	case NotStoredError:
+		return "NotStoredError"
+	case TemporaryFailureError:
+		return "TemporaryFailureError"
+	case TimeoutError:
+		return "TimeoutError"
+	case LockedError:
+		return "LockedError"
+	case NotFoundError:
+		return "NotFoundError"
+	case InvalidArgsError:
+		return "InvalidArgsError"
+	case InternalError:
+		return "InternalError"
+	case CircuitOpenError:
+		return "CircuitOpenError"
+	}
+	return "Error"
+}
+
+// isCASConflict reports whether a row fault comes from a stale cas.
+func isCASConflict(err error) bool {
+	_, ok := Cause(err).(CASMismatchError)
+	return ok
+}
+
+func openBucket(host, bucketName, bucketPassword string) (bucket, error) {
 	defer mu.Unlock()
 	mu.Lock()
 
@@ -87,26 +243,90 @@ func NewCouchbaseStore(host, bucketName, bucketPassword string) (*CouchbaseStore
 
 	if clust = clusters[host]; clust == nil {
 		if clust, err = gocb.Connect(host); err != nil {
+			defaultLogging.connected(host, bucketName, err)
 			return nil, err
 		}
 		clusters[host] = clust
 	}
 
-	if b, err := clust.OpenBucket(bucketName, bucketPassword); err == nil {
-		return &CouchbaseStore{name: "couchbase", bucket: b}, nil
+	b, err := clust.OpenBucket(bucketName, bucketPassword)
+	defaultLogging.connected(host, bucketName, err)
+	switch err {
+	case nil:
+		return gocbBucket{b}, nil
+	case gocb.ErrNoBucket:
+		err = NotFoundError{BucketNotFoundError{bucketName, err}}
+	case gocb.ErrAuthError, gocb.ErrAccessError:
+		err = InternalError{AccessDeniedError{err}}
+	}
+	return nil, err
+}
+
+//noinspection ALL
+func NewCouchbaseStore(host, bucketName, bucketPassword string) (*CouchbaseStore, error) {
+	if b, err := openBucket(host, bucketName, bucketPassword); err == nil {
+		c := newStore(b)
+		c.bucketName = bucketName
+		return c, nil
 	} else {
 		return nil, err
 	}
 }
 
+// WithContext returns a shallow copy of the store bound to ctx, e.g. to parent the spans of its
+// operations. The copy shares the connection and configuration of c at the time of the call.
+func (c *CouchbaseStore) WithContext(ctx context.Context) *CouchbaseStore {
+	cpy := c.view()
+	cpy.ctx = ctx
+	cpy.compose()
+	return cpy
+}
+
+// view returns a copy of the store sharing its connection. Closing the copy does nothing, the
+// connection is closed with the store it derives from.
+func (c *CouchbaseStore) view() *CouchbaseStore {
+	cpy := *c
+	cpy.isView = true
+	return &cpy
+}
+
+func (c *CouchbaseStore) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// Close closes the connection of the store. Closing a view, such as returned by WithContext,
+// does nothing.
 func (c *CouchbaseStore) Close() {
+	mu.Lock()
+	if c.closed || c.isView {
+		mu.Unlock()
+		return
+	}
+	c.closed = true
+	openStores--
+	mu.Unlock()
+
 	if c.bucket != nil {
 		c.bucket.Close()
 	}
 }
 
 func (c *CouchbaseStore) NewRow(id string) Row {
-	return newDoc(id)
+	return c.newDoc(id)
+}
+
+// newDoc returns a document serialized with the codec of the store.
+func (c *CouchbaseStore) newDoc(id string) *doc {
+	d := newDoc(id)
+	d.codec = c.codec
+	d.keys = c.keys
+	d.tenant = c.tenant
+	d.migrations = c.versions
+	d.deleted = c.withDeleted
+	return d
 }
 func (c *CouchbaseStore) NewQuery(statement string) Query {
 	return newQuery(statement)
@@ -121,6 +341,9 @@ func (c *CouchbaseStore) SetName(name string) error {
 }
 
 func (c *CouchbaseStore) Create(xs ...interface{}) ([]Row, bool) {
+	return c.bulk("Create", xs, c.create)
+}
+func (c *CouchbaseStore) create(xs ...interface{}) ([]Row, bool) {
 
 	ok := true
 	length := len(xs)
@@ -129,7 +352,7 @@ func (c *CouchbaseStore) Create(xs ...interface{}) ([]Row, bool) {
 	now := time.Now().UTC()
 
 	for i := 0; i < length; i++ {
-		doc := newDoc("")
+		doc := c.newDoc("")
 		rows[i] = doc
 		doc.SetMeta(CREATEDON, now)
 		doc.SetMeta(UPDATEDON, now)
@@ -148,6 +371,12 @@ func (c *CouchbaseStore) Create(xs ...interface{}) ([]Row, bool) {
 			doc.Data = value.GetData()
 			doc.mergeMetadata(value.Metadata())
 
+			if err := c.validate(doc); err != nil {
+				doc.fault = err
+				ok = false
+				continue
+			}
+
 			cas, _ := value.GetMeta(CAS).(gocb.Cas)
 			bulkOps[i] = &gocb.InsertOp{
 				Key:    doc.GetKey(),
@@ -166,11 +395,17 @@ func (c *CouchbaseStore) Create(xs ...interface{}) ([]Row, bool) {
 		}
 	}
 
-	if c.bucket.Do(bulkOps) != nil {
+	if c.bucket.Do(sendable(bulkOps)) != nil {
 		ok = false
 	}
 	for i := 0; i < length; i++ {
-		op := bulkOps[i].(*gocb.InsertOp)
+		op, sent := bulkOps[i].(*gocb.InsertOp)
+		if !sent {
+			continue
+		}
+		if op.Err == gocb.ErrKeyExists {
+			op.Cas, op.Err = c.replaceDeleted(op.Key, op.Value, op.Expiry, op.Err)
+		}
 		doc := rows[i].(*doc)
 		doc.SetMeta(CAS, op.Cas)
 		doc.SetMeta(TTL, nil)
@@ -183,8 +418,11 @@ func (c *CouchbaseStore) Create(xs ...interface{}) ([]Row, bool) {
 	return rows, ok
 }
 func (c *CouchbaseStore) CreateOne(x interface{}) Row {
+	return c.one("CreateOne", x, c.createOne)
+}
+func (c *CouchbaseStore) createOne(x interface{}) Row {
 
-	doc := newDoc("")
+	doc := c.newDoc("")
 
 	now := time.Now().UTC()
 	doc.SetMeta(CREATEDON, now)
@@ -199,11 +437,20 @@ func (c *CouchbaseStore) CreateOne(x interface{}) Row {
 		doc.mergeMetadata(row.Metadata())
 
 	} else {
-		doc.Id = uuid.NewV4().String()
+		doc.Id = c.keyStrategy().NewId()
 		doc.Data = x
 	}
 
-	if cas, err := c.bucket.Insert(doc.GetKey(), doc, makeUint32(doc.GetMeta(TTL))); err != nil {
+	if err := c.validate(doc); err != nil {
+		doc.fault = err
+		return doc
+	}
+
+	cas, err := c.bucket.Insert(doc.GetKey(), doc, makeUint32(doc.GetMeta(TTL)))
+	if err == gocb.ErrKeyExists {
+		cas, err = c.replaceDeleted(doc.GetKey(), doc, makeUint32(doc.GetMeta(TTL)), err)
+	}
+	if err != nil {
 		doc.fault = makeCreateError(err)
 	} else {
 		doc.SetMeta(CAS, cas)
@@ -213,6 +460,9 @@ func (c *CouchbaseStore) CreateOne(x interface{}) Row {
 }
 
 func (c *CouchbaseStore) Read(xs ...interface{}) ([]Row, bool) {
+	return c.bulk("Read", xs, c.read)
+}
+func (c *CouchbaseStore) read(xs ...interface{}) ([]Row, bool) {
 
 	ok := true
 	length := len(xs)
@@ -221,7 +471,7 @@ func (c *CouchbaseStore) Read(xs ...interface{}) ([]Row, bool) {
 
 	for i := 0; i < length; i++ {
 
-		doc := newDoc("")
+		doc := c.newDoc("")
 		rows[i] = doc
 
 		switch value := xs[i].(type) {
@@ -237,16 +487,12 @@ func (c *CouchbaseStore) Read(xs ...interface{}) ([]Row, bool) {
 			doc.Data = value.GetData()
 			doc.mergeMetadata(value.Metadata())
 
-			if lock := value.GetMeta(LOCK); lock != nil {
-				for _, x := range xs {
-					rows := rows[:0]
-					r := c.ReadOneWithType(x, nil)
-					if r.IsFaulted() {
-						ok = false
-					}
-					rows = append(rows, r)
+			// gocb has no bulk GetAndLock, documents are locked one at a time.
+			if makeUint32(value.GetMeta(LOCK)) > 0 {
+				if rows[i] = c.readOneWithType(value, nil); rows[i].IsFaulted() {
+					ok = false
 				}
-				return rows, ok
+				continue
 			}
 
 			bulkOps[i] = &gocb.GetOp{
@@ -266,28 +512,41 @@ func (c *CouchbaseStore) Read(xs ...interface{}) ([]Row, bool) {
 		}
 	}
 
-	if c.bucket.Do(bulkOps) != nil {
+	if c.bucket.Do(sendable(bulkOps)) != nil {
 		ok = false
 	}
+	docs := make([]*doc, 0, length)
 	for i := 0; i < length; i++ {
-		op := bulkOps[i].(*gocb.GetOp)
+		op, sent := bulkOps[i].(*gocb.GetOp)
+		if !sent {
+			continue
+		}
 		doc := rows[i].(*doc)
 		doc.SetMeta(CAS, op.Cas)
-		doc.SetMeta(TTL, nil)
 		if op.Err != nil {
 			ok = false
-			doc.fault = makeReadError(op.Err)
+			doc.fault = makeGetError(op.Err)
 		}
+		docs = append(docs, doc)
+	}
+	c.writeBack(docs...)
+	for _, doc := range docs {
+		doc.SetMeta(TTL, nil)
 	}
 
 	return rows, ok
 }
 func (c *CouchbaseStore) ReadOne(x interface{}) Row {
-	return c.ReadOneWithType(x, nil)
+	return c.one("ReadOne", x, func(x interface{}) Row {
+		return c.readOneWithType(x, nil)
+	})
 }
 func (c *CouchbaseStore) ReadOneWithType(x interface{}, out interface{}) Row {
+	return c.typed("ReadOneWithType", x, out, c.readOneWithType)
+}
+func (c *CouchbaseStore) readOneWithType(x interface{}, out interface{}) Row {
 
-	doc := newDoc("")
+	doc := c.newDoc("")
 	doc.Data = out
 
 	switch value := x.(type) {
@@ -315,19 +574,23 @@ func (c *CouchbaseStore) ReadOneWithType(x interface{}, out interface{}) Row {
 			doc.SetMeta(CAS, cas)
 		}
 	} else if cas, err := c.bucket.Get(doc.GetKey(), doc); err != nil {
-		doc.fault = makeReadError(err)
+		doc.fault = makeGetError(err)
 	} else {
 		doc.SetMeta(CAS, cas)
+		c.writeBack(doc)
 	}
 
 	return doc
 }
 
 func (c *CouchbaseStore) Unlock(xs ...interface{}) ([]Row, bool) {
+	return c.bulk("Unlock", xs, c.unlock)
+}
+func (c *CouchbaseStore) unlock(xs ...interface{}) ([]Row, bool) {
 	ok := true
 	rows := make([]Row, 0, len(xs))
 	for _, x := range xs {
-		r := c.UnlockOne(x)
+		r := c.unlockOne(x)
 		if r.IsFaulted() {
 			ok = false
 		}
@@ -336,8 +599,11 @@ func (c *CouchbaseStore) Unlock(xs ...interface{}) ([]Row, bool) {
 	return rows, ok
 }
 func (c *CouchbaseStore) UnlockOne(x interface{}) Row {
+	return c.one("UnlockOne", x, c.unlockOne)
+}
+func (c *CouchbaseStore) unlockOne(x interface{}) Row {
 
-	doc := newDoc("")
+	doc := c.newDoc("")
 
 	switch value := x.(type) {
 	case string:
@@ -368,6 +634,9 @@ func (c *CouchbaseStore) UnlockOne(x interface{}) Row {
 }
 
 func (c *CouchbaseStore) Replace(xs ...interface{}) ([]Row, bool) {
+	return c.bulk("Replace", xs, c.replace)
+}
+func (c *CouchbaseStore) replace(xs ...interface{}) ([]Row, bool) {
 
 	ok := true
 	length := len(xs)
@@ -376,7 +645,7 @@ func (c *CouchbaseStore) Replace(xs ...interface{}) ([]Row, bool) {
 	now := time.Now().UTC()
 
 	for i := 0; i < length; i++ {
-		doc := newDoc("")
+		doc := c.newDoc("")
 		rows[i] = doc
 
 		doc.SetMeta(UPDATEDON, now)
@@ -389,6 +658,12 @@ func (c *CouchbaseStore) Replace(xs ...interface{}) ([]Row, bool) {
 			doc.Data = value.GetData()
 			doc.mergeMetadata(value.Metadata())
 
+			if err := c.validate(doc); err != nil {
+				doc.fault = err
+				ok = false
+				continue
+			}
+
 			bulkOps[i] = &gocb.ReplaceOp{
 				Key:    doc.GetKey(),
 				Cas:    makeCAS(doc.GetMeta(CAS)),
@@ -402,26 +677,32 @@ func (c *CouchbaseStore) Replace(xs ...interface{}) ([]Row, bool) {
 		}
 	}
 
-	if c.bucket.Do(bulkOps) != nil {
+	if c.bucket.Do(sendable(bulkOps)) != nil {
 
 		ok = false
 	}
 	for i := 0; i < length; i++ {
-		op := bulkOps[i].(*gocb.ReplaceOp)
+		op, sent := bulkOps[i].(*gocb.ReplaceOp)
+		if !sent {
+			continue
+		}
 		doc := rows[i].(*doc)
-		doc.SetMeta(TTL, nil)
-		doc.SetMeta(CAS, op.Cas)
 		if op.Err != nil {
 			ok = false
-			doc.fault = makeMutationError(op.Err)
+			doc.fault = makeMutationError(op.Err, makeCAS(doc.GetMeta(CAS)))
 		}
+		doc.SetMeta(TTL, nil)
+		doc.SetMeta(CAS, op.Cas)
 	}
 
 	return rows, ok
 }
 func (c *CouchbaseStore) ReplaceOne(x interface{}) Row {
+	return c.one("ReplaceOne", x, c.replaceOne)
+}
+func (c *CouchbaseStore) replaceOne(x interface{}) Row {
 
-	doc := newDoc("")
+	doc := c.newDoc("")
 
 	now := time.Now().UTC()
 	doc.SetMeta(UPDATEDON, now)
@@ -435,12 +716,17 @@ func (c *CouchbaseStore) ReplaceOne(x interface{}) Row {
 		doc.mergeMetadata(value.Metadata())
 
 	} else {
-		doc.Id = uuid.NewV4().String()
+		doc.Id = c.keyStrategy().NewId()
 		doc.Data = x
 	}
 
+	if err := c.validate(doc); err != nil {
+		doc.fault = err
+		return doc
+	}
+
 	if cas, err := c.bucket.Replace(doc.GetKey(), doc, makeCAS(doc.GetMeta(CAS)), makeUint32(doc.GetMeta(TTL))); err != nil {
-		doc.fault = makeMutationError(err)
+		doc.fault = makeMutationError(err, makeCAS(doc.GetMeta(CAS)))
 	} else {
 		doc.SetMeta(TTL, nil)
 		doc.SetMeta(CAS, cas)
@@ -450,6 +736,9 @@ func (c *CouchbaseStore) ReplaceOne(x interface{}) Row {
 }
 
 func (c *CouchbaseStore) Upsert(xs ...interface{}) ([]Row, bool) {
+	return c.bulk("Upsert", xs, c.upsert)
+}
+func (c *CouchbaseStore) upsert(xs ...interface{}) ([]Row, bool) {
 
 	ok := true
 	length := len(xs)
@@ -458,7 +747,7 @@ func (c *CouchbaseStore) Upsert(xs ...interface{}) ([]Row, bool) {
 	now := time.Now().UTC()
 
 	for i := 0; i < length; i++ {
-		doc := newDoc("")
+		doc := c.newDoc("")
 		rows[i] = doc
 
 		doc.SetMeta(UPDATEDON, now)
@@ -470,6 +759,12 @@ func (c *CouchbaseStore) Upsert(xs ...interface{}) ([]Row, bool) {
 			doc.Data = value.GetData()
 			doc.mergeMetadata(value.Metadata())
 
+			if err := c.validate(doc); err != nil {
+				doc.fault = err
+				ok = false
+				continue
+			}
+
 			bulkOps[i] = &gocb.UpsertOp{
 				Key:    doc.GetKey(),
 				Cas:    makeCAS(doc.GetMeta(CAS)),
@@ -483,27 +778,33 @@ func (c *CouchbaseStore) Upsert(xs ...interface{}) ([]Row, bool) {
 		}
 	}
 
-	if c.bucket.Do(bulkOps) != nil {
+	if c.bucket.Do(sendable(bulkOps)) != nil {
 		ok = false
 	}
 	for i := 0; i < length; i++ {
 
-		op := bulkOps[i].(*gocb.UpsertOp)
+		op, sent := bulkOps[i].(*gocb.UpsertOp)
+		if !sent {
+			continue
+		}
 		doc := rows[i].(*doc)
 
-		doc.SetMeta(CAS, op.Cas)
-		doc.SetMeta(TTL, nil)
 		if op.Err != nil {
 			ok = false
-			doc.fault = makeMutationError(op.Err)
+			doc.fault = makeMutationError(op.Err, makeCAS(doc.GetMeta(CAS)))
 		}
+		doc.SetMeta(CAS, op.Cas)
+		doc.SetMeta(TTL, nil)
 	}
 
 	return rows, ok
 }
 func (c *CouchbaseStore) UpsertOne(x interface{}) Row {
+	return c.one("UpsertOne", x, c.upsertOne)
+}
+func (c *CouchbaseStore) upsertOne(x interface{}) Row {
 
-	doc := newDoc("")
+	doc := c.newDoc("")
 
 	now := time.Now().UTC()
 	doc.SetMeta(UPDATEDON, now)
@@ -517,12 +818,17 @@ func (c *CouchbaseStore) UpsertOne(x interface{}) Row {
 		doc.mergeMetadata(value.Metadata())
 
 	} else {
-		doc.Id = uuid.NewV4().String()
+		doc.Id = c.keyStrategy().NewId()
 		doc.Data = x
 	}
 
+	if err := c.validate(doc); err != nil {
+		doc.fault = err
+		return doc
+	}
+
 	if cas, err := c.bucket.Replace(doc.GetKey(), doc, makeCAS(doc.GetMeta(CAS)), makeUint32(doc.GetMeta(TTL))); err != nil {
-		doc.fault = makeMutationError(err)
+		doc.fault = makeMutationError(err, makeCAS(doc.GetMeta(CAS)))
 	} else {
 		doc.SetMeta(TTL, nil)
 		doc.SetMeta(CAS, cas)
@@ -532,12 +838,15 @@ func (c *CouchbaseStore) UpsertOne(x interface{}) Row {
 }
 
 func (c *CouchbaseStore) Update(xs ...interface{}) ([]Row, bool) {
+	return c.bulk("Update", xs, c.update)
+}
+func (c *CouchbaseStore) update(xs ...interface{}) ([]Row, bool) {
 	ok := true
 	length := len(xs)
 	rows := make([]Row, length, length)
 
 	for i := 0; i < length; i++ {
-		rows[i] = c.UpdateOne(xs[i])
+		rows[i] = c.updateOne(xs[i])
 		if !rows[i].IsFaulted() {
 			ok = false
 		}
@@ -545,12 +854,22 @@ func (c *CouchbaseStore) Update(xs ...interface{}) ([]Row, bool) {
 	return rows, ok
 }
 func (c *CouchbaseStore) UpdateOne(x interface{}) Row {
+	return c.one("UpdateOne", x, c.updateOne)
+}
+func (c *CouchbaseStore) updateOne(x interface{}) Row {
 	return &doc{
 		fault: errors.New("Not Implemented"),
 	}
 }
 
 func (c *CouchbaseStore) Destroy(xs ...interface{}) ([]Row, bool) {
+	return c.bulk("Destroy", xs, c.destroy)
+}
+func (c *CouchbaseStore) destroy(xs ...interface{}) ([]Row, bool) {
+
+	if c.softDelete != nil {
+		return c.markAll(xs, true)
+	}
 
 	ok := true
 	length := len(xs)
@@ -559,7 +878,7 @@ func (c *CouchbaseStore) Destroy(xs ...interface{}) ([]Row, bool) {
 
 	for i := 0; i < length; i++ {
 
-		doc := newDoc("")
+		doc := c.newDoc("")
 		rows[i] = doc
 
 		switch value := xs[i].(type) {
@@ -590,11 +909,14 @@ func (c *CouchbaseStore) Destroy(xs ...interface{}) ([]Row, bool) {
 		}
 	}
 
-	if c.bucket.Do(bulkOps) != nil {
+	if c.bucket.Do(sendable(bulkOps)) != nil {
 		ok = false
 	}
 	for i := 0; i < length; i++ {
-		op := bulkOps[i].(*gocb.RemoveOp)
+		op, sent := bulkOps[i].(*gocb.RemoveOp)
+		if !sent {
+			continue
+		}
 		doc := rows[i].(*doc)
 		doc.SetMeta(TTL, nil)
 		doc.SetMeta(CAS, op.Cas)
@@ -607,8 +929,15 @@ func (c *CouchbaseStore) Destroy(xs ...interface{}) ([]Row, bool) {
 	return rows, ok
 }
 func (c *CouchbaseStore) DestroyOne(x interface{}) Row {
+	return c.one("DestroyOne", x, c.destroyOne)
+}
+func (c *CouchbaseStore) destroyOne(x interface{}) Row {
 
-	doc := newDoc("")
+	if c.softDelete != nil {
+		return c.mark(x, true)
+	}
+
+	doc := c.newDoc("")
 
 	switch value := x.(type) {
 	case string:
@@ -637,6 +966,9 @@ func (c *CouchbaseStore) DestroyOne(x interface{}) Row {
 }
 
 func (c *CouchbaseStore) Touch(xs ...interface{}) ([]Row, bool) {
+	return c.bulk("Touch", xs, c.touch)
+}
+func (c *CouchbaseStore) touch(xs ...interface{}) ([]Row, bool) {
 
 	ok := true
 	length := len(xs)
@@ -645,14 +977,13 @@ func (c *CouchbaseStore) Touch(xs ...interface{}) ([]Row, bool) {
 
 	for i := 0; i < length; i++ {
 
-		doc := newDoc("")
+		doc := c.newDoc("")
 		rows[i] = doc
 
 		switch value := xs[i].(type) {
 		case string:
-			bulkOps[i] = &gocb.GetOp{
-				Key:   value,
-				Value: doc,
+			bulkOps[i] = &gocb.TouchOp{
+				Key: value,
 			}
 		case Row:
 			doc.key = value.GetKey()
@@ -676,11 +1007,14 @@ func (c *CouchbaseStore) Touch(xs ...interface{}) ([]Row, bool) {
 		}
 	}
 
-	if c.bucket.Do(bulkOps) != nil {
+	if c.bucket.Do(sendable(bulkOps)) != nil {
 		ok = false
 	}
 	for i := 0; i < length; i++ {
-		op := bulkOps[i].(*gocb.TouchOp)
+		op, sent := bulkOps[i].(*gocb.TouchOp)
+		if !sent {
+			continue
+		}
 		doc := rows[i].(*doc)
 		doc.SetMeta(CAS, op.Cas)
 		doc.SetMeta(TTL, nil)
@@ -693,8 +1027,11 @@ func (c *CouchbaseStore) Touch(xs ...interface{}) ([]Row, bool) {
 	return rows, ok
 }
 func (c *CouchbaseStore) TouchOne(x interface{}) Row {
+	return c.one("TouchOne", x, c.touchOne)
+}
+func (c *CouchbaseStore) touchOne(x interface{}) Row {
 
-	doc := newDoc("")
+	doc := c.newDoc("")
 
 	switch value := x.(type) {
 	case string:
@@ -720,7 +1057,18 @@ func (c *CouchbaseStore) TouchOne(x interface{}) Row {
 }
 
 func (c *CouchbaseStore) Exec(q Query) (QueryResult, error) {
-	params := q.GetParams()
+	return c.query("Exec", q, c.exec)
+}
+func (c *CouchbaseStore) exec(q Query) (QueryResult, error) {
+	if err := c.tenantQuery(q); err != nil {
+		return nil, err
+	}
+	return c.execute(q)
+}
+
+// execute runs q, without the checks applied to the queries of the caller.
+func (c *CouchbaseStore) execute(q Query) (QueryResult, error) {
+	params := c.tenantParams(q.GetParams())
 	n1qlquery := gocb.NewN1qlQuery(q.GetStatement())
 
 	if value, ok := q.GetMeta(ADHOC).(bool); ok {
@@ -738,7 +1086,7 @@ func (c *CouchbaseStore) Exec(q Query) (QueryResult, error) {
 	if results, err := c.bucket.ExecuteN1qlQuery(n1qlquery, params); err != nil {
 		return nil, err
 	} else {
-		return newQueryResult(q, results), nil
+		return c.tenantRows(newQueryResult(q, results, c.resultCodec())), nil
 	}
 
 }
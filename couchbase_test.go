@@ -6,6 +6,7 @@ import (
 	"github.com/Tlantic/go-nosql"
 	"github.com/twinj/uuid"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -28,9 +29,39 @@ type User struct {
 	Password string `json:"password"`
 }
 
+// newTestStore opens the store used by an integration test. With COUCHBASE_HOST set the test runs
+// against the cluster, recording the session to testdata when COUCHBASE_RECORD is also set.
+// Otherwise the recorded session is replayed. A missing session skips the test, and fails it when
+// COUCHBASE_REQUIRE_SESSIONS is set, so sessions left unrecorded don't go unnoticed once recorded.
+func newTestStore(t *testing.T) (*CouchbaseStore, error) {
+	golden := filepath.Join("testdata", t.Name()+".json")
+	host := os.Getenv("COUCHBASE_HOST")
+
+	switch {
+	case host == "":
+		if _, err := os.Stat(golden); os.IsNotExist(err) {
+			if os.Getenv("COUCHBASE_REQUIRE_SESSIONS") != "" {
+				t.Fatalf("no recorded session at %s, record it with COUCHBASE_HOST and COUCHBASE_RECORD set", golden)
+			}
+			t.Skipf("COUCHBASE_HOST is not set and there is no recorded session at %s", golden)
+		}
+		return NewReplayStore(golden)
+	case os.Getenv("COUCHBASE_RECORD") != "":
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			return nil, err
+		}
+		return NewRecordingStore(host, os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"), golden)
+	default:
+		return NewCouchbaseStore(host, os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	}
+}
+
 
 
 func TestNewCouchbaseStore(t *testing.T) {
+	if os.Getenv("COUCHBASE_HOST") == "" {
+		t.Skip("COUCHBASE_HOST is not set")
+	}
 	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
 	if err != nil {
 		t.Error(err)
@@ -40,7 +71,7 @@ func TestNewCouchbaseStore(t *testing.T) {
 }
 
 func TestCouchbaseStore_Create(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Fatal(err)
 	} else {
@@ -81,7 +112,7 @@ func TestCouchbaseStore_Create(t *testing.T) {
 }
 
 func TestCouchbaseStore_DestroyOne(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -129,7 +160,7 @@ func TestCouchbaseStore_DestroyOne(t *testing.T) {
 }
 
 func TestCouchbaseStore_Destroy(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -170,7 +201,7 @@ func TestCouchbaseStore_Destroy(t *testing.T) {
 }
 
 func TestCouchbaseStore_CreateOne(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -191,7 +222,7 @@ func TestCouchbaseStore_CreateOne(t *testing.T) {
 		// Test Conflict
 		r := store.CreateOne(d)
 		if _, ok := r.Fault().(database.AlreadyExistsError); !ok {
-			t.Error("Expected AlreadyExistsError. got %+v.\n", r.Fault())
+			t.Errorf("Expected AlreadyExistsError. got %+v.\n", r.Fault())
 		}
 
 		time.Sleep(2 * time.Second)
@@ -212,7 +243,7 @@ func TestCouchbaseStore_CreateOne(t *testing.T) {
 }
 
 func TestCouchbaseStore_ReadOneWithType(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -245,7 +276,7 @@ func TestCouchbaseStore_ReadOneWithType(t *testing.T) {
 }
 
 func TestCouchbaseStore_ReadOne(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -309,7 +340,7 @@ func TestCouchbaseStore_ReadOne(t *testing.T) {
 }
 
 func TestCouchbaseStore_Read(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -373,7 +404,7 @@ func TestCouchbaseStore_Read(t *testing.T) {
 }
 
 func TestCouchbaseStore_ReplaceOne(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -407,7 +438,7 @@ func TestCouchbaseStore_ReplaceOne(t *testing.T) {
 }
 
 func TestCouchbaseStore_Replace(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -454,7 +485,7 @@ func TestCouchbaseStore_Replace(t *testing.T) {
 }
 
 func TestCouchbaseStore_TouchOne(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -506,7 +537,7 @@ func TestCouchbaseStore_TouchOne(t *testing.T) {
 }
 
 func TestCouchbaseStore_Touch(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -580,7 +611,7 @@ func TestCouchbaseStore_Touch(t *testing.T) {
 }
 
 func TestCouchbaseStore_Exec(t *testing.T) {
-	store, err := NewCouchbaseStore(os.Getenv("COUCHBASE_HOST"), os.Getenv("COUCHBASE_BUCKET"), os.Getenv("COUCHBASE_PASSWORD"))
+	store, err := newTestStore(t)
 	if err != nil {
 		t.Error(err)
 	} else {
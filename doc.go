@@ -1,8 +1,6 @@
 package couchbase
 
 import (
-	"bytes"
-	"encoding/json"
 	"reflect"
 	"strings"
 	"time"
@@ -13,16 +11,15 @@ import (
 // Assert interface implementation
 var _ database.Row = (*doc)(nil)
 
-type raw struct {
-	Id   string                 `json:"_uId"`
-	Type string                 `json:"_type"`
-	Data json.RawMessage        `json:"data"`
-	Meta map[string]interface{} `json:"meta"`
-}
-
 type doc struct {
-	key   string
-	fault error
+	key        string
+	fault      error
+	codec      Codec
+	keys       KeyStrategy
+	tenant     string
+	migrations *Migrations
+	migrated   bool
+	deleted    bool
 
 	Id   string                 `json:"_uId"`
 	Type string                 `json:"_type"`
@@ -46,14 +43,10 @@ func newDoc(id string) *doc {
 
 func (row *doc) GetKey() string {
 	if row.key == "" {
-		if t := row.GetType(); t != "" {
-			buf := bytes.NewBufferString(row.GetType())
-			buf.WriteString("::")
-			buf.WriteString(row.Id)
-			return buf.String()
-		} else {
-			return row.Id
+		if row.keys == nil {
+			return Keys{}.Key(row.GetType(), row.Id)
 		}
+		return row.keys.Key(row.GetType(), row.Id)
 	}
 	return row.key
 }
@@ -137,80 +130,62 @@ func (doc *doc) Fault() error {
 	return doc.fault
 }
 
-func (doc *doc) MarshalJSON() ([]byte, error) {
-	pre := raw{
-		Id:   doc.GetId(),
-		Type: doc.GetType(),
-		Meta: doc.Meta,
-	}
-
-	switch value := pre.Meta[database.CREATEDON].(type) {
-	case time.Time:
-		pre.Meta[database.CREATEDON] = value.UnixNano()
-	case int64:
-		pre.Meta[database.CREATEDON] = value
-	default:
-		delete(pre.Meta, database.CREATEDON)
-	}
-
-	switch value := pre.Meta[database.UPDATEDON].(type) {
-	case time.Time:
-		pre.Meta[database.UPDATEDON] = value.UnixNano()
-	case int64:
-		pre.Meta[database.UPDATEDON] = value
-	default:
-		delete(pre.Meta, database.UPDATEDON)
+func (doc *doc) getCodec() Codec {
+	if doc.codec == nil {
+		return EnvelopeCodec{}
 	}
+	return doc.codec
+}
 
-	if data, err := json.Marshal(doc.Data); err != nil {
-		return nil, err
-	} else {
-		pre.Data = data
+func (doc *doc) MarshalJSON() ([]byte, error) {
+	meta := doc.Meta
+	if doc.tenant != "" {
+		meta = doc.Metadata()
+		meta[TENANT] = doc.tenant
 	}
-
-	return json.Marshal(&pre)
+	return doc.getCodec().Encode(&Envelope{
+		Id:      doc.GetId(),
+		Type:    doc.GetType(),
+		Data:    doc.Data,
+		Meta:    meta,
+		Version: doc.migrations.Version(doc.GetType()),
+	})
 }
 func (doc *doc) UnmarshalJSON(data []byte) error {
 
-	pre := raw{}
-
-	dec := json.NewDecoder(bytes.NewReader(data))
-	dec.UseNumber()
-	if err := dec.Decode(&pre); err != nil {
-		return err
+	e := Envelope{
+		Id:   doc.Id,
+		Type: doc.Type,
+		Data: doc.Data,
 	}
-
-	doc.Id = pre.Id
-	doc.Type = pre.Type
-
-	if dbytes, err := pre.Data.MarshalJSON(); err != nil {
-		return err
-	} else if doc.Data == nil {
-		doc.Data = dbytes
-	} else if err := json.Unmarshal(dbytes, doc.Data); err != nil {
+	if doc.migrations != nil {
+		e.Data = nil
+	}
+	if err := doc.getCodec().Decode(data, &e); err != nil {
 		return err
 	}
-
-	doc.Meta = pre.Meta
-	cdate := pre.Meta[database.CREATEDON]
-	if cdate != nil {
-		switch value := cdate.(type) {
-		case json.Number:
-			if value, err := value.Int64(); err == nil {
-				doc.Meta[database.CREATEDON] = time.Unix(0, value)
-			}
-		}
+	if !doc.owned(e.Meta) {
+		return errOtherTenant
+	}
+	if _, deleted := e.Meta[DELETEDON]; deleted && !doc.deleted {
+		return errDeleted
 	}
 
-	udate := pre.Meta[database.UPDATEDON]
-	if udate != nil {
-		switch value := udate.(type) {
-		case json.Number:
-			if value, err := value.Int64(); err == nil {
-				doc.Meta[database.UPDATEDON] = time.Unix(0, value)
-			}
+	if doc.migrations != nil {
+		raw, _ := e.Data.([]byte)
+		var err error
+		if raw, doc.migrated, err = doc.migrations.migrate(e.Type, e.Version, raw); err != nil {
+			return err
+		}
+		if e.Data, err = decodeData(raw, doc.Data); err != nil {
+			return err
 		}
 	}
 
+	doc.Id = e.Id
+	doc.Type = e.Type
+	doc.Data = e.Data
+	doc.Meta = e.Meta
+
 	return nil
 }
@@ -0,0 +1,274 @@
+package couchbase
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Assert interface implementation
+var (
+	_ Codec       = EncryptionCodec{}
+	_ KeyProvider = (*KeyRing)(nil)
+)
+
+// KeyProvider resolves the keys encrypting document fields. Keys are AES keys of 16, 24 or 32 bytes.
+type KeyProvider interface {
+	// EncryptionKey returns the id and value of the key currently encrypting the fields tagged with name.
+	EncryptionKey(name string) (id string, key []byte, err error)
+	// DecryptionKey returns the key identified by id.
+	DecryptionKey(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding keys in memory. The last key added with a name encrypts the
+// fields tagged with it, keys added before keep decrypting the fields they encrypted.
+type KeyRing struct {
+	locker  sync.RWMutex
+	keys    map[string][]byte
+	current map[string]string
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: map[string][]byte{}, current: map[string]string{}}
+}
+
+// Add rotates the key encrypting the fields tagged with name to key, identified by id.
+func (r *KeyRing) Add(name, id string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if _, ok := r.keys[id]; ok {
+		return fmt.Errorf("couchbase: key %q already exists", id)
+	}
+	r.keys[id] = append([]byte(nil), key...)
+	r.current[name] = id
+	return nil
+}
+
+func (r *KeyRing) EncryptionKey(name string) (string, []byte, error) {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	id, ok := r.current[name]
+	if !ok {
+		return "", nil, fmt.Errorf("couchbase: no key named %q", name)
+	}
+	return id, r.keys[id], nil
+}
+
+func (r *KeyRing) DecryptionKey(id string) ([]byte, error) {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("couchbase: no key with id %q", id)
+	}
+	return key, nil
+}
+
+// ciphertext is a field encrypted by EncryptionCodec, stored in place of its value.
+type ciphertext struct {
+	Kid  string `json:"kid"`
+	Alg  string `json:"alg"`
+	Data []byte `json:"ciphertext"`
+}
+
+const aesGCM = "AES-GCM"
+
+// errRawEncryption faults the documents EncryptionCodec encodes with RawCodec, which doesn't store
+// the id and type their ciphertexts are bound to.
+var errRawEncryption = errors.New("couchbase: RawCodec can't store encrypted documents")
+
+// encryptedFields caches the fields to encrypt by type, as JSON names mapped to key names.
+var encryptedFields sync.Map
+
+// fieldsToEncrypt returns the top-level fields of the struct held by data tagged with cbcrypt.
+func fieldsToEncrypt(data interface{}) map[string]string {
+	t := reflect.TypeOf(data)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	if fields, ok := encryptedFields.Load(t); ok {
+		return fields.(map[string]string)
+	}
+
+	fields := map[string]string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("cbcrypt")
+		if key == "" || f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[name] = key
+	}
+	encryptedFields.Store(t, fields)
+	return fields
+}
+
+// EncryptionCodec encrypts the top-level data fields tagged `cbcrypt:"<key name>"` with AES-GCM
+// before encoding the documents with Codec. The ciphertext is stored in place of the field along
+// with the id of the key encrypting it, so fields encrypted with rotated keys are still decrypted.
+// Ciphertexts are bound to the type, id and tenant of their document and to their field, so they
+// don't decrypt once copied elsewhere. Codec must store the id and type: documents encoded with
+// RawCodec fail. To compress documents too, set Codec to a CompressionCodec, which fails encoding
+// documents with an EncryptionCodec as it would leave no field to encrypt.
+type EncryptionCodec struct {
+	// Codec encodes the documents. Defaults to EnvelopeCodec.
+	Codec Codec
+	// Keys provides the encryption keys.
+	Keys KeyProvider
+}
+
+func (c EncryptionCodec) codec() Codec {
+	if c.Codec == nil {
+		return EnvelopeCodec{}
+	}
+	return c.Codec
+}
+
+func (c EncryptionCodec) Encode(e *Envelope) ([]byte, error) {
+	if _, ok := baseCodec(c).(RawCodec); ok {
+		return nil, errRawEncryption
+	}
+
+	fields := fieldsToEncrypt(e.Data)
+	if len(fields) == 0 {
+		return c.codec().Encode(e)
+	}
+	if c.Keys == nil {
+		return nil, errors.New("couchbase: encryption requires a key provider")
+	}
+
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	for name, key := range fields {
+		if value, ok := obj[name]; ok {
+			if obj[name], err = c.encrypt(key, additionalData(e, name), value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c.codec().Encode(&Envelope{Id: e.Id, Type: e.Type, Data: obj, Meta: e.Meta, Version: e.Version})
+}
+
+func (c EncryptionCodec) Decode(data []byte, e *Envelope) error {
+	out := e.Data
+	e.Data = nil
+	if err := c.codec().Decode(data, e); err != nil {
+		return err
+	}
+
+	raw, _ := e.Data.([]byte)
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &obj); err == nil {
+		decrypted := false
+		for name, value := range obj {
+			field := ciphertext{}
+			if json.Unmarshal(value, &field) != nil || field.Alg != aesGCM || field.Kid == "" {
+				continue
+			}
+			if obj[name], err = c.decrypt(name, additionalData(e, name), field); err != nil {
+				return err
+			}
+			decrypted = true
+		}
+		if decrypted {
+			if raw, err = json.Marshal(obj); err != nil {
+				return err
+			}
+		}
+	}
+
+	if value, err := decodeData(raw, out); err != nil {
+		return err
+	} else {
+		e.Data = value
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData returns the data authenticated along the field name of the document e: its
+// type, id and tenant, which make up its key.
+func additionalData(e *Envelope, name string) []byte {
+	tenant, _ := e.Meta[TENANT].(string)
+	data, _ := json.Marshal([]string{e.Type, e.Id, tenant, name})
+	return data
+}
+
+// encrypt seals the JSON value of a field, authenticating ad.
+func (c EncryptionCodec) encrypt(key string, ad, value []byte) (json.RawMessage, error) {
+	id, secret, err := c.Keys.EncryptionKey(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(ciphertext{
+		Kid:  id,
+		Alg:  aesGCM,
+		Data: gcm.Seal(nonce, nonce, value, ad),
+	})
+}
+
+func (c EncryptionCodec) decrypt(name string, ad []byte, field ciphertext) (json.RawMessage, error) {
+	if c.Keys == nil {
+		return nil, errors.New("couchbase: decryption requires a key provider")
+	}
+	secret, err := c.Keys.DecryptionKey(field.Kid)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(field.Data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("couchbase: field %q has a truncated ciphertext", name)
+	}
+	nonce, sealed := field.Data[:gcm.NonceSize()], field.Data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, ad)
+	if err != nil {
+		return nil, fmt.Errorf("couchbase: decrypting field %q: %v", name, err)
+	}
+	return plain, nil
+}
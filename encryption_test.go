@@ -0,0 +1,172 @@
+package couchbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password" cbcrypt:"credentials"`
+	Pin      int    `cbcrypt:"credentials"`
+}
+
+func TestEncryptionCodec(t *testing.T) {
+	keys := NewKeyRing()
+	if err := keys.Add("credentials", "k1", bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	codec := EncryptionCodec{Keys: keys}
+
+	old, err := codec.Encode(&Envelope{Id: "1", Data: &Credentials{Username: "username", Password: "secret", Pin: 1234}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(old, []byte("secret")) || bytes.Contains(old, []byte("1234")) {
+		t.Errorf("Expected the tagged fields to be encrypted. got %s.", old)
+	}
+	if !bytes.Contains(old, []byte(`"username":"username"`)) || !bytes.Contains(old, []byte(`"kid":"k1"`)) {
+		t.Errorf("Expected the other fields in clear and the key id. got %s.", old)
+	}
+
+	// Documents encrypted before a rotation still decrypt.
+	if err := keys.Add("credentials", "k2", bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := codec.Encode(&Envelope{Id: "1", Data: &Credentials{Password: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(rotated, []byte(`"kid":"k2"`)) {
+		t.Errorf("Expected the rotated key to encrypt. got %s.", rotated)
+	}
+
+	for _, data := range [][]byte{old, rotated} {
+		out := &Envelope{Data: &Credentials{}}
+		if err := codec.Decode(data, out); err != nil {
+			t.Fatal(err)
+		}
+		if c := out.Data.(*Credentials); c.Password != "secret" {
+			t.Errorf("Expected the password to decrypt. got %+v.", c)
+		}
+	}
+
+	// Raw reads are decrypted too.
+	out := &Envelope{}
+	if err := codec.Decode(old, out); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(out.Data.([]byte), []byte(`"password":"secret"`)) {
+		t.Errorf("Expected the raw data to be decrypted. got %s.", out.Data)
+	}
+
+	if err := (EncryptionCodec{Keys: NewKeyRing()}).Decode(old, &Envelope{}); err == nil {
+		t.Error("Expected decrypting with an unknown key to fail.")
+	}
+	if _, err := (EncryptionCodec{}).Encode(&Envelope{Data: &Credentials{}}); err == nil {
+		t.Error("Expected encrypting without keys to fail.")
+	}
+}
+
+func TestEncryptionCodec_Tampering(t *testing.T) {
+	keys := NewKeyRing()
+	keys.Add("credentials", "k1", bytes.Repeat([]byte{1}, 32))
+	codec := EncryptionCodec{Codec: FlatCodec{}, Keys: keys}
+
+	data, err := codec.Encode(&Envelope{Data: &Credentials{Password: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A ciphertext moved to another field doesn't decrypt.
+	swapped := bytes.Replace(data, []byte(`"password"`), []byte(`"username"`), 1)
+	swapped = bytes.Replace(swapped, []byte(`"username":""`), []byte(`"password":""`), 1)
+	if err := codec.Decode(swapped, &Envelope{Data: &Credentials{}}); err == nil {
+		t.Errorf("Expected a swapped ciphertext to fail. got %s.", swapped)
+	}
+
+	// A ciphertext copied to another document doesn't decrypt.
+	source, err := codec.Encode(&Envelope{Id: "1", Type: "user", Data: &Credentials{Password: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]json.RawMessage{}
+	json.Unmarshal(source, &fields)
+	for _, e := range []*Envelope{
+		{Id: "2", Type: "user"},
+		{Id: "1", Type: "admin"},
+		{Id: "1", Type: "user", Meta: map[string]interface{}{TENANT: "acme"}},
+	} {
+		e.Data = &Credentials{Password: "other"}
+		target, err := codec.Encode(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied := map[string]json.RawMessage{}
+		json.Unmarshal(target, &copied)
+		copied["password"] = fields["password"]
+		data, _ := json.Marshal(copied)
+		if err := codec.Decode(data, &Envelope{Data: &Credentials{}}); err == nil {
+			t.Errorf("Expected a ciphertext copied to %s %s of %v to fail.", e.Type, e.Id, e.Meta)
+		}
+	}
+}
+
+func TestEncryptionCodec_Compression(t *testing.T) {
+	keys := NewKeyRing()
+	keys.Add("credentials", "k1", bytes.Repeat([]byte{1}, 32))
+	e := &Envelope{Id: "1", Type: "user", Data: &Credentials{Username: "username", Password: "secret"}}
+
+	// Encrypted documents are compressed.
+	codec := EncryptionCodec{Codec: CompressionCodec{}, Keys: keys}
+	data, err := codec.Encode(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(COMPRESSION)) {
+		t.Errorf("Expected the document to be compressed. got %s.", data)
+	}
+	c := &Credentials{}
+	if err := codec.Decode(data, &Envelope{Data: c}); err != nil {
+		t.Fatal(err)
+	} else if c.Password != "secret" {
+		t.Errorf("Expected the password to decrypt. got %q.", c.Password)
+	}
+
+	// Compressed documents would leave no field to encrypt.
+	if _, err := (CompressionCodec{Codec: EncryptionCodec{Keys: keys}}).Encode(e); err != errCompressedEncryption {
+		t.Errorf("Expected errCompressedEncryption. got %v.", err)
+	}
+
+	// RawCodec doesn't store the id and type ciphertexts are bound to.
+	for _, codec := range []Codec{EncryptionCodec{Codec: RawCodec{}, Keys: keys}, EncryptionCodec{Codec: CompressionCodec{Codec: RawCodec{}}, Keys: keys}} {
+		if _, err := codec.Encode(e); err != errRawEncryption {
+			t.Errorf("Expected errRawEncryption. got %v.", err)
+		}
+	}
+}
+
+func TestCouchbaseStore_Encryption(t *testing.T) {
+	keys := NewKeyRing()
+	keys.Add("credentials", "k1", bytes.Repeat([]byte{1}, 32))
+
+	fake := newFakeBucket()
+	store := newStore(fake)
+	store.SetCodec(EncryptionCodec{Codec: CompressionCodec{Threshold: 1 << 10}, Keys: keys})
+
+	d := store.NewRow("1")
+	d.SetType("user")
+	d.SetData(&Credentials{Username: "username", Password: "secret"})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if bytes.Contains(fake.items["user::1"].value, []byte("secret")) {
+		t.Errorf("Expected the password to be stored encrypted. got %s.", fake.items["user::1"].value)
+	}
+
+	c := &Credentials{}
+	if row := store.ReadOneWithType("user::1", c); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if c.Password != "secret" {
+		t.Errorf("Expected the password to decrypt. got %q.", c.Password)
+	}
+}
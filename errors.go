@@ -0,0 +1,193 @@
+package couchbase
+
+import (
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+// The errors below tell apart failures go-nosql reports with the same error. Faults remain the
+// go-nosql errors they always were, caused by one of them, e.g. a stale cas faults with a
+// database.LockedError caused by a CASMismatchError. Cause returns it:
+//
+//	if _, ok := couchbase.Cause(row.Fault()).(couchbase.CASMismatchError); ok { ... }
+//
+// Each one wraps the gocb error it maps, for errors.Is. go-nosql errors can't be unwrapped: with
+// SetErrorWrapping, faults can, see it.
+
+// CASMismatchError causes the database.LockedError of a write made with a cas the document no
+// longer has: it changed since it was read.
+type CASMismatchError struct {
+	Err error
+}
+
+func (e CASMismatchError) Error() string {
+	return "couchbase: cas mismatch: " + e.Err.Error()
+}
+func (e CASMismatchError) Unwrap() error {
+	return e.Err
+}
+
+// DocumentLockedError causes the database.LockedError of an operation on a document locked by
+// GetAndLock, or being written by a transaction.
+type DocumentLockedError struct {
+	Err error
+}
+
+func (e DocumentLockedError) Error() string {
+	return "couchbase: document is locked: " + e.Err.Error()
+}
+func (e DocumentLockedError) Unwrap() error {
+	return e.Err
+}
+
+// TemporaryError causes the database.TemporaryFailureError of an operation the cluster couldn't
+// handle yet, being overloaded or out of memory. It may be retried.
+type TemporaryError struct {
+	Err error
+}
+
+func (e TemporaryError) Error() string {
+	return "couchbase: temporary failure: " + e.Err.Error()
+}
+func (e TemporaryError) Unwrap() error {
+	return e.Err
+}
+
+// DurabilityAmbiguousError causes the database.TimeoutError of a write whose durability couldn't
+// be confirmed in time: it may or may not have been applied.
+type DurabilityAmbiguousError struct {
+	Err error
+}
+
+func (e DurabilityAmbiguousError) Error() string {
+	return "couchbase: durability ambiguous: " + e.Err.Error()
+}
+func (e DurabilityAmbiguousError) Unwrap() error {
+	return e.Err
+}
+
+// AccessDeniedError causes the database.InternalError of an operation the credentials of the
+// store don't allow.
+type AccessDeniedError struct {
+	Err error
+}
+
+func (e AccessDeniedError) Error() string {
+	return "couchbase: access denied: " + e.Err.Error()
+}
+func (e AccessDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// BucketNotFoundError causes the database.NotFoundError returned when opening a store on a
+// bucket the cluster doesn't have.
+type BucketNotFoundError struct {
+	Bucket string
+	Err    error
+}
+
+func (e BucketNotFoundError) Error() string {
+	return "couchbase: bucket " + e.Bucket + " not found: " + e.Err.Error()
+}
+func (e BucketNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// Cause returns the error causing the go-nosql error err, e.g. the CASMismatchError of a
+// database.LockedError, unwrapped or wrapped by SetErrorWrapping. Other errors are returned as is.
+func Cause(err error) error {
+	if w, ok := err.(wrappedError); ok {
+		err = w.err
+	}
+	cause, _ := nosqlCause(err)
+	return cause
+}
+
+// nosqlCause returns the error causing err, reporting whether err is a go-nosql error.
+func nosqlCause(err error) (error, bool) {
+	switch e := err.(type) {
+	case database.AlreadyExistsError:
+		return e.Err, true
+	case database.TooBigError:
+		return e.Err, true
+	case database.NotStoredError:
+		return e.Err, true
+	case database.TemporaryFailureError:
+		return e.Err, true
+	case database.TimeoutError:
+		return e.Err, true
+	case database.LockedError:
+		return e.Err, true
+	case database.NotFoundError:
+		return e.Err, true
+	case database.InvalidArgsError:
+		return e.Err, true
+	case database.InternalError:
+		return e.Err, true
+	}
+	return err, false
+}
+
+// wrappedError is a go-nosql error that errors.As and errors.Is see through, see SetErrorWrapping.
+type wrappedError struct {
+	err error
+}
+
+func (e wrappedError) Error() string {
+	return e.err.Error()
+}
+func (e wrappedError) Unwrap() []error {
+	return []error{e.err, Cause(e.err)}
+}
+
+// SetErrorWrapping makes the rows returned by the store fault with errors that errors.As and
+// errors.Is see through, when enabled. They match the go-nosql error the rows fault with
+// otherwise, its cause, such as CASMismatchError, and the gocb error causing it:
+//
+//	var mismatch couchbase.CASMismatchError
+//	if errors.As(row.Fault(), &mismatch) { ... }
+//	var locked database.LockedError
+//	if errors.As(row.Fault(), &locked) { ... }
+//	if errors.Is(row.Fault(), gocb.ErrKeyExists) { ... }
+//
+// The faults aren't go-nosql errors anymore and can't be type asserted to them, so wrapping is off
+// by default. Middleware sees the faults unwrapped.
+func (c *CouchbaseStore) SetErrorWrapping(enabled bool) {
+	c.wrapErrors = enabled
+}
+
+// wrapFault wraps the go-nosql fault of row when the store is set to, see SetErrorWrapping.
+func (c *CouchbaseStore) wrapFault(row database.Row) database.Row {
+	if d, ok := row.(*doc); ok && c.wrapErrors {
+		if _, nosql := nosqlCause(d.fault); nosql {
+			d.fault = wrappedError{d.fault}
+		}
+	}
+	return row
+}
+
+// wrapFaults wraps the go-nosql faults of rows like wrapFault.
+func (c *CouchbaseStore) wrapFaults(rows []database.Row, ok bool) ([]database.Row, bool) {
+	for _, row := range rows {
+		c.wrapFault(row)
+	}
+	return rows, ok
+}
+
+// casMismatch faults a write made with a stale cas, checked by the store.
+func casMismatch() error {
+	return database.LockedError{CASMismatchError{gocb.ErrKeyExists}}
+}
+
+// makeCommonError maps the errors any operation may fail with, returning nil for others.
+func makeCommonError(err error) error {
+	switch err {
+	case gocb.ErrBusy, gocb.ErrOverload, gocb.ErrOutOfMemory:
+		return database.TemporaryFailureError{TemporaryError{err}}
+	case gocb.ErrDurabilityTimeout:
+		return database.TimeoutError{DurabilityAmbiguousError{err}}
+	case gocb.ErrAuthError, gocb.ErrAccessError:
+		return database.InternalError{AccessDeniedError{err}}
+	}
+	return nil
+}
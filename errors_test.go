@@ -0,0 +1,123 @@
+package couchbase
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+func TestErrors(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+
+	d := store.NewRow("1")
+	d.SetType("user")
+	d.SetData(&User{Username: "username"})
+	created := store.CreateOne(d)
+	if created.IsFaulted() {
+		t.Fatal(created.Fault())
+	}
+	stale := created.GetMeta(database.CAS)
+	if row := store.ReplaceOne(created); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+
+	// A stale cas is told apart from a lock, both still being go-nosql LockedErrors.
+	created.SetMeta(database.CAS, stale)
+	mismatch := store.ReplaceOne(created).Fault()
+	if _, ok := mismatch.(database.LockedError); !ok {
+		t.Errorf("Expected LockedError. got %v.", mismatch)
+	}
+	if _, ok := Cause(mismatch).(CASMismatchError); !ok {
+		t.Errorf("Expected CASMismatchError. got %v.", Cause(mismatch))
+	}
+	if !errors.Is(Cause(mismatch), gocb.ErrKeyExists) {
+		t.Error("Expected the gocb error to be wrapped.")
+	}
+	if row := store.DestroyOne(created); !isCASConflict(row.Fault()) {
+		t.Errorf("Expected CASMismatchError. got %v.", row.Fault())
+	}
+
+	lock := store.NewRow("1")
+	lock.SetType("user")
+	lock.SetMeta(database.LOCK, 5)
+	if row := store.ReadOne(lock); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	locked := store.ReadOne(lock).Fault()
+	if _, ok := locked.(database.LockedError); !ok {
+		t.Errorf("Expected LockedError. got %v.", locked)
+	}
+	if _, ok := Cause(locked).(DocumentLockedError); !ok {
+		t.Errorf("Expected DocumentLockedError. got %v.", Cause(locked))
+	}
+
+	// Temporary failures of plain reads come from the cluster, not from locks.
+	store.InjectFaults(NewFaultInjector(1, Fault{Ops: []Operation{OpGet}, Err: gocb.ErrTmpFail}))
+	if fault := store.ReadOne("user::1").Fault(); errorClass(fault) != "TemporaryError" {
+		t.Errorf("Expected TemporaryError. got %s: %v.", errorClass(fault), fault)
+	} else if _, ok := fault.(database.TemporaryFailureError); !ok {
+		t.Errorf("Expected TemporaryFailureError. got %v.", fault)
+	}
+	store.InjectFaults(nil)
+
+	for _, tt := range []struct {
+		err   error
+		class string
+		nosql error
+	}{
+		{gocb.ErrOverload, "TemporaryError", database.TemporaryFailureError{TemporaryError{gocb.ErrOverload}}},
+		{gocb.ErrDurabilityTimeout, "DurabilityAmbiguousError", database.TimeoutError{DurabilityAmbiguousError{gocb.ErrDurabilityTimeout}}},
+		{gocb.ErrAccessError, "AccessDeniedError", database.InternalError{AccessDeniedError{gocb.ErrAccessError}}},
+	} {
+		if err := makeMutationError(tt.err, 1); err != tt.nosql || errorClass(err) != tt.class {
+			t.Errorf("Expected %v logged as %s. got %s: %v.", tt.nosql, tt.class, errorClass(err), err)
+		}
+	}
+}
+
+func TestCouchbaseStore_SetErrorWrapping(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	store.SetErrorWrapping(true)
+	users := NewRepository[User](store)
+	if _, err := users.Insert("1", User{Username: "username"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Faults are seen through by errors.As and errors.Is, down to the gocb error.
+	row := store.ReadOne("user::1")
+	row.SetMeta(database.CAS, row.GetMeta(database.CAS).(gocb.Cas)+1)
+	fault := store.ReplaceOne(row).Fault()
+	var mismatch CASMismatchError
+	if !errors.As(fault, &mismatch) {
+		t.Errorf("Expected CASMismatchError. got %v.", fault)
+	}
+	var locked database.LockedError
+	if !errors.As(fault, &locked) {
+		t.Errorf("Expected LockedError. got %v.", fault)
+	}
+	if !errors.Is(fault, gocb.ErrKeyExists) {
+		t.Errorf("Expected gocb.ErrKeyExists. got %v.", fault)
+	}
+	if !isCASConflict(fault) || errorClass(fault) != "CASMismatchError" {
+		t.Errorf("Expected the fault to be told a cas conflict. got %s.", errorClass(fault))
+	}
+
+	_, _, err := users.Get("2")
+	var missing database.NotFoundError
+	if !errors.As(err, &missing) || !errors.Is(err, gocb.ErrKeyNotFound) {
+		t.Errorf("Expected NotFoundError. got %v.", err)
+	}
+	if rows, _ := store.Read("user::2"); !errors.Is(rows[0].Fault(), gocb.ErrKeyNotFound) {
+		t.Errorf("Expected gocb.ErrKeyNotFound in bulk. got %v.", rows[0].Fault())
+	}
+
+	// Without wrapping, faults are go-nosql errors.
+	store.SetErrorWrapping(false)
+	if _, ok := store.ReadOne("user::2").Fault().(database.NotFoundError); !ok {
+		t.Error("Expected NotFoundError.")
+	}
+}
@@ -0,0 +1,211 @@
+package couchbase
+
+import (
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocb"
+)
+
+// Assert interface implementation
+var _ bucket = (*faultyBucket)(nil)
+
+// Fault describes an error or a delay injected into the operations it matches.
+type Fault struct {
+	// Ops restricts the fault to some operations. Every operation matches when empty.
+	Ops []Operation
+	// Keys restricts the fault to matching document keys. Every key matches when nil,
+	// queries have no key and only match faults without a pattern.
+	Keys *regexp.Regexp
+	// Rate is the probability of injecting the fault into a matching operation. The fault
+	// is always injected when zero.
+	Rate float64
+	// Err is returned in place of the cluster's response, e.g. gocb.ErrTimeout or gocb.ErrTmpFail.
+	// The operation reaches the cluster after Latency when nil.
+	Err error
+	// Latency delays the operation.
+	Latency time.Duration
+}
+
+func (f *Fault) matches(op Operation, key string) bool {
+	if len(f.Ops) > 0 {
+		found := false
+		for _, o := range f.Ops {
+			if o == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Keys != nil {
+		return op != OpQuery && f.Keys.MatchString(key)
+	}
+	return true
+}
+
+// FaultInjector decides which operations of a store fail. Faults are evaluated in the order
+// they were added and the first one matching an operation is injected. Decisions are drawn
+// from a seeded source, so a sequence of operations faults the same way on every run.
+type FaultInjector struct {
+	locker sync.Mutex
+	rand   *rand.Rand
+	faults []Fault
+}
+
+func NewFaultInjector(seed int64, faults ...Fault) *FaultInjector {
+	return &FaultInjector{
+		rand:   rand.New(rand.NewSource(seed)),
+		faults: faults,
+	}
+}
+
+func (f *FaultInjector) Add(fault Fault) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.faults = append(f.faults, fault)
+}
+
+func (f *FaultInjector) Clear() {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.faults = nil
+}
+
+// next returns the fault injected into an operation, if any.
+func (f *FaultInjector) next(op Operation, key string) (Fault, bool) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	for _, fault := range f.faults {
+		if !fault.matches(op, key) {
+			continue
+		}
+		if fault.Rate == 0 || f.rand.Float64() < fault.Rate {
+			return fault, true
+		}
+	}
+	return Fault{}, false
+}
+
+// InjectFaults makes the store fail operations as decided by f, before they reach the cluster.
+// Passing nil stops injecting faults.
+func (c *CouchbaseStore) InjectFaults(f *FaultInjector) {
+	c.faults = f
+	c.compose()
+}
+
+type faultyBucket struct {
+	bucket
+	faults *FaultInjector
+}
+
+func (b *faultyBucket) inject(op Operation, key string) error {
+	fault, ok := b.faults.next(op, key)
+	if !ok {
+		return nil
+	}
+	if fault.Latency > 0 {
+		time.Sleep(fault.Latency)
+	}
+	return fault.Err
+}
+
+func (b *faultyBucket) Get(key string, valuePtr interface{}) (gocb.Cas, error) {
+	if err := b.inject(OpGet, key); err != nil {
+		return 0, err
+	}
+	return b.bucket.Get(key, valuePtr)
+}
+func (b *faultyBucket) GetAndLock(key string, lockTime uint32, valuePtr interface{}) (gocb.Cas, error) {
+	if err := b.inject(OpGetAndLock, key); err != nil {
+		return 0, err
+	}
+	return b.bucket.GetAndLock(key, lockTime, valuePtr)
+}
+func (b *faultyBucket) Unlock(key string, cas gocb.Cas) (gocb.Cas, error) {
+	if err := b.inject(OpUnlock, key); err != nil {
+		return 0, err
+	}
+	return b.bucket.Unlock(key, cas)
+}
+func (b *faultyBucket) Touch(key string, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	if err := b.inject(OpTouch, key); err != nil {
+		return 0, err
+	}
+	return b.bucket.Touch(key, cas, expiry)
+}
+func (b *faultyBucket) Insert(key string, value interface{}, expiry uint32) (gocb.Cas, error) {
+	if err := b.inject(OpInsert, key); err != nil {
+		return 0, err
+	}
+	return b.bucket.Insert(key, value, expiry)
+}
+func (b *faultyBucket) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	if err := b.inject(OpReplace, key); err != nil {
+		return 0, err
+	}
+	return b.bucket.Replace(key, value, cas, expiry)
+}
+func (b *faultyBucket) Remove(key string, cas gocb.Cas) (gocb.Cas, error) {
+	if err := b.inject(OpRemove, key); err != nil {
+		return 0, err
+	}
+	return b.bucket.Remove(key, cas)
+}
+func (b *faultyBucket) Counter(key string, delta, initial int64, expiry uint32) (uint64, gocb.Cas, error) {
+	if err := b.inject(OpCounter, key); err != nil {
+		return 0, 0, err
+	}
+	return b.bucket.Counter(key, delta, initial, expiry)
+}
+
+func (b *faultyBucket) Expiry(key string) (uint32, gocb.Cas, error) {
+	if err := b.inject(OpExpiry, key); err != nil {
+		return 0, 0, err
+	}
+	return b.bucket.Expiry(key)
+}
+
+// Do fails the ops of the batch matching a fault and sends the others to the cluster.
+// The batch is delayed by the largest latency injected into its ops.
+func (b *faultyBucket) Do(ops []gocb.BulkOp) error {
+	var latency time.Duration
+	pending := make([]gocb.BulkOp, 0, len(ops))
+
+	for _, op := range ops {
+		name, key := bulkOpKey(op)
+		fault, ok := b.faults.next(name, key)
+		if !ok {
+			pending = append(pending, op)
+			continue
+		}
+		if fault.Latency > latency {
+			latency = fault.Latency
+		}
+		if fault.Err != nil {
+			setBulkOpResult(op, 0, fault.Err)
+		} else {
+			pending = append(pending, op)
+		}
+	}
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return b.bucket.Do(pending)
+}
+
+func (b *faultyBucket) ExecuteN1qlQuery(q *gocb.N1qlQuery, params interface{}) (gocb.QueryResults, error) {
+	if err := b.inject(OpQuery, ""); err != nil {
+		return nil, err
+	}
+	return b.bucket.ExecuteN1qlQuery(q, params)
+}
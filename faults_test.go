@@ -0,0 +1,73 @@
+package couchbase
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+func TestCouchbaseStore_InjectFaults(t *testing.T) {
+	store := newStore(newFakeBucket())
+	store.InjectFaults(NewFaultInjector(1, Fault{
+		Ops:  []Operation{OpInsert},
+		Keys: regexp.MustCompile("^user::2$"),
+		Err:  gocb.ErrTmpFail,
+	}, Fault{
+		Ops: []Operation{OpGet},
+		Err: gocb.ErrTimeout,
+	}))
+
+	d1 := newDoc("1")
+	d1.SetType("user")
+	d1.SetData(&User{Username: "1"})
+	d2 := newDoc("2")
+	d2.SetType("user")
+	d2.SetData(&User{Username: "2"})
+
+	// Only the matching op of the batch fails.
+	rows, ok := store.Create(d1, d2)
+	if ok {
+		t.Fatal("Expected the batch to fail.")
+	}
+	if rows[0].IsFaulted() {
+		t.Error(rows[0].Fault())
+	}
+	if !errors.As(rows[1].Fault(), &database.TemporaryFailureError{}) {
+		t.Errorf("Expected TemporaryFailureError. got %+v.", rows[1].Fault())
+	}
+
+	if row := store.ReadOne(d1.GetKey()); !row.IsFaulted() {
+		t.Error("Expected TimeoutError. got nil.")
+	} else if _, ok := row.Fault().(database.TimeoutError); !ok {
+		t.Errorf("Expected TimeoutError. got %+v.", row.Fault())
+	}
+
+	store.InjectFaults(nil)
+	if row := store.ReadOne(d1.GetKey()); row.IsFaulted() {
+		t.Error(row.Fault())
+	}
+}
+
+func TestFaultInjector_Seed(t *testing.T) {
+	fault := Fault{Rate: 0.5, Err: gocb.ErrTimeout}
+	f1 := NewFaultInjector(42, fault)
+	f2 := NewFaultInjector(42, fault)
+
+	injected := 0
+	for i := 0; i < 100; i++ {
+		_, ok1 := f1.next(OpGet, "key")
+		_, ok2 := f2.next(OpGet, "key")
+		if ok1 != ok2 {
+			t.Fatalf("Expected injectors with the same seed to agree on operation %d.", i)
+		}
+		if ok1 {
+			injected++
+		}
+	}
+	if injected == 0 || injected == 100 {
+		t.Errorf("Expected about half of the operations to fault. got %d.", injected)
+	}
+}
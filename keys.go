@@ -0,0 +1,182 @@
+package couchbase
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+)
+
+// Assert interface implementation
+var _ KeyStrategy = Keys{}
+
+// KeyStrategy builds the keys of the documents from their type and id, recovers them from keys,
+// e.g. returned by queries, and generates the ids of the documents created without one.
+type KeyStrategy interface {
+	Key(typ, id string) string
+	Parse(key string) (typ, id string, ok bool)
+	NewId() string
+}
+
+// IdGenerator generates document ids.
+type IdGenerator func() string
+
+// Keys is the default KeyStrategy. With its zero value, keys are "<type>::<id>", or the id for
+// documents without type, and ids are UUIDv4.
+type Keys struct {
+	// Separator joins the prefix, type and id of keys. Defaults to "::".
+	Separator string
+	// Prefix namespaces the keys, when set.
+	Prefix string
+	// Generator generates ids. Defaults to UUIDv4.
+	Generator IdGenerator
+	// Hash replaces ids with their SHA-256 in keys, bounding their length. Parse then returns
+	// the hash in place of the id.
+	Hash bool
+}
+
+func (k Keys) separator() string {
+	if k.Separator == "" {
+		return "::"
+	}
+	return k.Separator
+}
+
+func (k Keys) Key(typ, id string) string {
+	if k.Hash {
+		sum := sha256.Sum256([]byte(id))
+		id = hex.EncodeToString(sum[:])
+	}
+
+	parts := make([]string, 0, 3)
+	if k.Prefix != "" {
+		parts = append(parts, k.Prefix)
+	}
+	if typ != "" {
+		parts = append(parts, typ)
+	}
+	return strings.Join(append(parts, id), k.separator())
+}
+
+// Parse splits key into its type and id. Types can't contain the separator, ids can. Keys
+// without the prefix of the strategy aren't parsed.
+func (k Keys) Parse(key string) (string, string, bool) {
+	sep := k.separator()
+	if k.Prefix != "" {
+		if !strings.HasPrefix(key, k.Prefix+sep) {
+			return "", "", false
+		}
+		key = key[len(k.Prefix)+len(sep):]
+	}
+	if i := strings.Index(key, sep); i >= 0 {
+		return key[:i], key[i+len(sep):], true
+	}
+	return "", key, true
+}
+
+func (k Keys) NewId() string {
+	if k.Generator == nil {
+		return UUIDv4()
+	}
+	return k.Generator()
+}
+
+// SetKeyStrategy builds the keys and ids of the documents of the store with s. Passing nil
+// restores Keys{}.
+func (c *CouchbaseStore) SetKeyStrategy(s KeyStrategy) {
+	c.keys = s
+}
+
+// ParseKey recovers the type and id of the document stored at key.
+func (c *CouchbaseStore) ParseKey(key string) (typ, id string, ok bool) {
+	return c.keyStrategy().Parse(key)
+}
+
+func (c *CouchbaseStore) keyStrategy() KeyStrategy {
+	if c.keys == nil {
+		return Keys{}
+	}
+	return c.keys
+}
+
+// UUIDv4 returns a random UUID.
+func UUIDv4() string {
+	return uuid.NewV4().String()
+}
+
+// UUIDv7 returns a UUID starting with the current time in milliseconds, so ids sort by creation.
+func UUIDv7() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID returns a ULID: the current time in milliseconds and 80 random bits, in 26 characters of
+// Crockford's base32, so ids sort by creation.
+func ULID() string {
+	var out [26]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 9; i >= 0; i-- {
+		out[i] = crockford[ms&31]
+		ms >>= 5
+	}
+
+	var r [10]byte
+	if _, err := rand.Read(r[:]); err != nil {
+		panic(err)
+	}
+	for h := 0; h < 2; h++ {
+		var v uint64
+		for _, b := range r[h*5 : h*5+5] {
+			v = v<<8 | uint64(b)
+		}
+		for i := 7; i >= 0; i-- {
+			out[10+h*8+i] = crockford[v&31]
+			v >>= 5
+		}
+	}
+	return string(out[:])
+}
+
+// Snowflake returns a generator of 63 bits ids made of the milliseconds elapsed since epoch,
+// node, of 10 bits, and a sequence of 12 bits. Ids are zero-padded decimals, sorting by creation.
+func Snowflake(node int64, epoch time.Time) IdGenerator {
+	var locker sync.Mutex
+	var last, seq int64
+	node &= 1<<10 - 1
+
+	return func() string {
+		locker.Lock()
+		defer locker.Unlock()
+
+		now := int64(time.Since(epoch) / time.Millisecond)
+		if now < last {
+			now = last
+		}
+		if now == last {
+			seq = (seq + 1) & (1<<12 - 1)
+			if seq == 0 {
+				// The sequence is exhausted, borrow the next millisecond.
+				now++
+			}
+		} else {
+			seq = 0
+		}
+		last = now
+		return fmt.Sprintf("%019d", now<<22|node<<12|seq)
+	}
+}
@@ -0,0 +1,94 @@
+package couchbase
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeys(t *testing.T) {
+	for _, tt := range []struct {
+		keys     Keys
+		typ, id  string
+		expected string
+	}{
+		{Keys{}, "user", "1", "user::1"},
+		{Keys{}, "", "1", "1"},
+		{Keys{Separator: ":"}, "user", "1", "user:1"},
+		{Keys{Prefix: "acme"}, "user", "a::b", "acme::user::a::b"},
+	} {
+		key := tt.keys.Key(tt.typ, tt.id)
+		if key != tt.expected {
+			t.Errorf("Expected key %s. got %s.", tt.expected, key)
+		}
+		if typ, id, ok := tt.keys.Parse(key); !ok || typ != tt.typ || id != tt.id {
+			t.Errorf("Expected %s to parse as %q and %q. got %q and %q.", key, tt.typ, tt.id, typ, id)
+		}
+	}
+
+	if _, _, ok := (Keys{Prefix: "acme"}).Parse("other::user::1"); ok {
+		t.Error("Expected keys without the prefix not to parse.")
+	}
+	if key := (Keys{Hash: true}).Key("user", strings.Repeat("x", 300)); len(key) != len("user::")+64 {
+		t.Errorf("Expected the id to be hashed. got %s.", key)
+	}
+}
+
+func TestIdGenerators(t *testing.T) {
+	for name, tt := range map[string]struct {
+		generate IdGenerator
+		format   *regexp.Regexp
+	}{
+		"uuidv7":    {UUIDv7, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		"ulid":      {ULID, regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)},
+		"snowflake": {Snowflake(1, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)), regexp.MustCompile(`^[0-9]{19}$`)},
+	} {
+		var ids []string
+		for i := 0; i < 3; i++ {
+			ids = append(ids, tt.generate())
+			time.Sleep(2 * time.Millisecond)
+		}
+		for _, id := range ids {
+			if !tt.format.MatchString(id) {
+				t.Errorf("%s: unexpected id %s.", name, id)
+			}
+		}
+		if !sort.StringsAreSorted(ids) || ids[0] == ids[1] {
+			t.Errorf("%s: expected ids to sort by creation. got %v.", name, ids)
+		}
+	}
+
+	// Snowflake ids generated within a millisecond are unique.
+	generate := Snowflake(1, time.Now())
+	seen := map[string]bool{}
+	for i := 0; i < 5000; i++ {
+		id := generate()
+		if seen[id] {
+			t.Fatalf("Duplicate id %s.", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestCouchbaseStore_SetKeyStrategy(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	store.SetKeyStrategy(Keys{Separator: "/", Prefix: "app", Generator: ULID})
+
+	row := store.CreateOne(&User{Username: "username"})
+	if row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if len(row.GetId()) != 26 || row.GetKey() != "app/user/"+row.GetId() {
+		t.Errorf("Expected a ULID keyed app/user/<id>. got %s.", row.GetKey())
+	}
+	if _, stored := fake.items[row.GetKey()]; !stored {
+		t.Errorf("Expected the document at %s.", row.GetKey())
+	}
+
+	if typ, id, ok := store.ParseKey(row.GetKey()); !ok || typ != "user" || id != row.GetId() {
+		t.Errorf("Expected user and %s. got %s and %s.", row.GetId(), typ, id)
+	}
+}
@@ -0,0 +1,164 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+const (
+	// leaseType is the type of the documents holding leases.
+	leaseType = "_lease"
+	// fenceType is the type of the counters issuing the fencing tokens of leases.
+	fenceType = "_fence"
+)
+
+// ErrLeaseHeld is returned when acquiring a lease held by another owner.
+var ErrLeaseHeld = errors.New("couchbase: lease is held")
+
+// ErrLeaseLost is returned when renewing or releasing a lease that expired or was taken over.
+var ErrLeaseLost = errors.New("couchbase: lease was lost")
+
+// Lease is the exclusive right of an owner over a name, until it expires. Leases are documents
+// inserted with a TTL: the server removes them once expired, letting another owner acquire them.
+type Lease struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	// Token is the fencing token of the lease, greater than the tokens of the leases acquired
+	// over the name before it. Resources guarded by the lease should reject the requests carrying
+	// a token lower than the last one they saw, as sent by an owner unaware it lost its lease.
+	Token uint64 `json:"token"`
+	// Expires is when the lease expires, as estimated by the owner.
+	Expires time.Time `json:"expires"`
+
+	store *CouchbaseStore
+	cas   gocb.Cas
+}
+
+// leaseExpiry converts the ttl of a lease to the expiry of its document, rounding up.
+func leaseExpiry(ttl time.Duration) (uint32, error) {
+	if ttl < time.Second {
+		return 0, database.InvalidArgsError{errors.New("couchbase: leases last at least a second")}
+	}
+	return makeExpiry(ttl), nil
+}
+
+func (c *CouchbaseStore) leaseDoc(name string, lease *Lease) *doc {
+	d := c.newDoc(name)
+	d.Type = leaseType
+	d.Data = lease
+	return d
+}
+
+// AcquireLease acquires the lease over name for owner, for ttl. It fails with ErrLeaseHeld while
+// another lease over name, of any owner, hasn't expired or been released.
+func (c *CouchbaseStore) AcquireLease(name, owner string, ttl time.Duration) (*Lease, error) {
+	expiry, err := leaseExpiry(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{Name: name, Owner: owner, Expires: time.Now().Add(ttl), store: c}
+	d := c.leaseDoc(name, lease)
+	cas, err := c.bucket.Insert(d.GetKey(), d, expiry)
+	if err == gocb.ErrKeyExists {
+		return nil, ErrLeaseHeld
+	} else if err != nil {
+		return nil, makeCreateError(err)
+	}
+
+	// The token is issued once the lease is held, so tokens increase in the order leases are
+	// held: an owner stalled before inserting its lease can't hold it with a lower token.
+	if lease.Token, _, err = c.bucket.Counter(c.keyStrategy().Key(fenceType, name), 1, 1, 0); err != nil {
+		c.bucket.Remove(d.GetKey(), cas)
+		return nil, makeMutationError(err, 0)
+	}
+	if lease.cas, err = c.bucket.Replace(d.GetKey(), d, cas, expiry); err == gocb.ErrKeyNotFound || err == gocb.ErrKeyExists {
+		return nil, ErrLeaseLost
+	} else if err != nil {
+		return nil, makeMutationError(err, cas)
+	}
+	return lease, nil
+}
+
+// LockLease acquires the lease over name like AcquireLease, waiting for it while it is held,
+// until ctx is done.
+func (c *CouchbaseStore) LockLease(ctx context.Context, name, owner string, ttl time.Duration) (*Lease, error) {
+	poll := ttl / 10
+	if poll > time.Second {
+		poll = time.Second
+	}
+
+	for {
+		lease, err := c.AcquireLease(name, owner, ttl)
+		if err != ErrLeaseHeld {
+			return lease, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// CurrentLease returns the lease held over name. It fails with NotFoundError when there is none.
+// The lease returned can't be renewed or released. Its token is zero while it is being acquired.
+func (c *CouchbaseStore) CurrentLease(name string) (*Lease, error) {
+	lease := &Lease{}
+	d := c.leaseDoc(name, lease)
+	if _, err := c.bucket.Get(d.GetKey(), d); err != nil {
+		return nil, makeGetError(err)
+	}
+	return lease, nil
+}
+
+// Renew extends the lease for ttl from now. It fails with ErrLeaseLost if the lease expired.
+// The lease is replaced with its cas rather than touched, since touches ignore the cas and would
+// renew the lease of another owner.
+func (l *Lease) Renew(ttl time.Duration) error {
+	if l.store == nil || l.cas == 0 {
+		return ErrLeaseLost
+	}
+	expiry, err := leaseExpiry(ttl)
+	if err != nil {
+		return err
+	}
+
+	renewed := *l
+	renewed.Expires = time.Now().Add(ttl)
+	d := l.store.leaseDoc(l.Name, &renewed)
+	cas, err := l.store.bucket.Replace(d.GetKey(), d, l.cas, expiry)
+	switch err {
+	case nil:
+		l.Expires, l.cas = renewed.Expires, cas
+		return nil
+	case gocb.ErrKeyNotFound, gocb.ErrKeyExists:
+		l.cas = 0
+		return ErrLeaseLost
+	}
+	return makeMutationError(err, l.cas)
+}
+
+// Release gives the lease up, letting another owner acquire it. It fails with ErrLeaseLost if
+// the lease already expired.
+func (l *Lease) Release() error {
+	if l.store == nil || l.cas == 0 {
+		return ErrLeaseLost
+	}
+
+	d := l.store.leaseDoc(l.Name, nil)
+	_, err := l.store.bucket.Remove(d.GetKey(), l.cas)
+	switch err {
+	case nil:
+		l.cas = 0
+		return nil
+	case gocb.ErrKeyNotFound, gocb.ErrKeyExists:
+		l.cas = 0
+		return ErrLeaseLost
+	}
+	return makeMutationError(err, l.cas)
+}
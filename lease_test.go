@@ -0,0 +1,135 @@
+package couchbase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+func TestCouchbaseStore_AcquireLease(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+
+	leader, err := store.AcquireLease("cron", "a", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AcquireLease("cron", "b", 10*time.Second); err != ErrLeaseHeld {
+		t.Errorf("Expected ErrLeaseHeld. got %v.", err)
+	}
+	if current, err := store.CurrentLease("cron"); err != nil {
+		t.Fatal(err)
+	} else if current.Owner != "a" || current.Token != leader.Token {
+		t.Errorf("Expected the lease of a. got %+v.", current)
+	}
+	if err := leader.Renew(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CurrentLease("cron"); err == nil {
+		t.Error("Expected the lease to be released.")
+	} else if _, ok := err.(database.NotFoundError); !ok {
+		t.Errorf("Expected NotFoundError. got %v.", err)
+	}
+
+	// A lease taken over once expired is lost to its former owner, whose token is lower.
+	former, err := store.AcquireLease("cron", "a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(fake.items, "_lease::cron")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	current, err := store.LockLease(ctx, "cron", "b", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Token <= former.Token {
+		t.Errorf("Expected fencing tokens to increase. got %d then %d.", former.Token, current.Token)
+	}
+	if err := former.Renew(time.Second); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost. got %v.", err)
+	}
+	if err := former.Release(); err != ErrLeaseLost {
+		t.Errorf("Expected ErrLeaseLost. got %v.", err)
+	}
+
+	// Waiting for a held lease stops with the context.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := store.LockLease(ctx, "cron", "a", time.Second); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded. got %v.", err)
+	}
+}
+
+// stallingBucket runs stall before the first insert, as if the owner inserting stalled.
+type stallingBucket struct {
+	*fakeBucket
+	stall func()
+}
+
+func (b *stallingBucket) Insert(key string, value interface{}, expiry uint32) (gocb.Cas, error) {
+	if stall := b.stall; stall != nil {
+		b.stall = nil
+		stall()
+	}
+	return b.fakeBucket.Insert(key, value, expiry)
+}
+
+func TestCouchbaseStore_AcquireLeaseStalled(t *testing.T) {
+	fake := newFakeBucket()
+	other := newStore(fake)
+	var before *Lease
+	stalling := &stallingBucket{fakeBucket: fake, stall: func() {
+		lease, err := other.AcquireLease("cron", "b", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := lease.Release(); err != nil {
+			t.Fatal(err)
+		}
+		before = lease
+	}}
+
+	// The lease held after another one has a greater token, though its owner started first.
+	lease, err := newStore(stalling).AcquireLease("cron", "a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Token <= before.Token {
+		t.Errorf("Expected fencing tokens to increase. got %d then %d.", before.Token, lease.Token)
+	}
+	if current, err := other.CurrentLease("cron"); err != nil {
+		t.Fatal(err)
+	} else if current.Token != lease.Token {
+		t.Errorf("Expected the lease to be stored with its token. got %+v.", current)
+	}
+}
+
+func TestCouchbaseStore_AcquireLeaseExpiry(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+
+	// Leases longer than 30 days expire at a Unix time.
+	ttl := 60 * 24 * time.Hour
+	lease, err := store.AcquireLease("cron", "a", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiry := int64(fake.items["_lease::cron"].expiry); expiry < time.Now().Add(ttl).Unix() {
+		t.Errorf("Expected the lease to expire in 60 days. got %d.", expiry)
+	}
+
+	// Failing to release a lease doesn't report it as missing.
+	store.InjectFaults(NewFaultInjector(1, Fault{Ops: []Operation{OpRemove}, Err: gocb.ErrTimeout}))
+	if err := lease.Release(); err == nil {
+		t.Fatal("Expected TimeoutError. got nil.")
+	} else if _, ok := err.(database.TimeoutError); !ok {
+		t.Errorf("Expected TimeoutError. got %v.", err)
+	}
+}
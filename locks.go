@@ -0,0 +1,85 @@
+package couchbase
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+// MaxLockDuration is the longest time the server keeps a document locked.
+const MaxLockDuration = 30 * time.Second
+
+// lockTime converts a lock duration to the seconds sent to the server, rounding up.
+func lockTime(d time.Duration) (uint32, error) {
+	if d <= 0 || d > MaxLockDuration {
+		return 0, database.InvalidArgsError{fmt.Errorf("couchbase: lock duration must be within (0, %s], got %s", MaxLockDuration, d)}
+	}
+	return uint32((d + time.Second - 1) / time.Second), nil
+}
+
+// WithLock locks the document at key for up to duration and runs fn with its row, unlocking the
+// document once fn returns or panics. Locking a document already locked fails with a LockedError
+// caused by DocumentLockedError, set a RetryPolicy to wait for it.
+// fn may replace or remove the document with the cas of the row, which unlocks it as well.
+func (c *CouchbaseStore) WithLock(key string, duration time.Duration, fn func(row database.Row) error) error {
+	return c.WithLocks([]string{key}, duration, func(rows []database.Row) error {
+		return fn(rows[0])
+	})
+}
+
+// WithLocks locks the documents at keys, like WithLock, and runs fn with their rows, in the
+// order of keys. Documents are locked in key order, so callers locking overlapping keys don't
+// deadlock, and unlocked in reverse order. Failing to lock a document unlocks the others.
+func (c *CouchbaseStore) WithLocks(keys []string, duration time.Duration, fn func(rows []database.Row) error) (err error) {
+	ltime, err := lockTime(duration)
+	if err != nil {
+		return err
+	}
+
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	locked := make(map[string]database.Row, len(sorted))
+	order := make([]string, 0, len(sorted))
+
+	defer func() {
+		for i := len(order) - 1; i >= 0; i-- {
+			if unlockErr := c.release(locked[order[i]]); unlockErr != nil && err == nil {
+				err = unlockErr
+			}
+		}
+	}()
+
+	for _, key := range sorted {
+		if _, dup := locked[key]; dup {
+			continue
+		}
+		d := c.newDoc("")
+		d.key = key
+		d.SetMeta(database.LOCK, ltime)
+		row := c.ReadOne(d)
+		if row.IsFaulted() {
+			return row.Fault()
+		}
+		locked[key] = row
+		order = append(order, key)
+	}
+
+	rows := make([]database.Row, len(keys))
+	for i, key := range keys {
+		rows[i] = locked[key]
+	}
+	return fn(rows)
+}
+
+// release unlocks a document locked by WithLocks. Documents no longer locked with the cas of
+// row, because they were written, removed or their lock expired, are ignored.
+func (c *CouchbaseStore) release(row database.Row) error {
+	err := c.UnlockOne(row).Fault()
+	switch err.(type) {
+	case database.LockedError, database.NotFoundError:
+		return nil
+	}
+	return err
+}
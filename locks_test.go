@@ -0,0 +1,123 @@
+package couchbase
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+func TestCouchbaseStore_WithLock(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	users := NewRepository[User](store)
+	for _, id := range []string{"1", "2"} {
+		if _, err := users.Insert(id, User{Username: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := store.WithLock("user::1", time.Second, func(row database.Row) error {
+		if !fake.items["user::1"].locked {
+			t.Error("Expected the document to be locked.")
+		}
+		if err := store.WithLock("user::1", time.Second, func(database.Row) error { return nil }); err == nil {
+			t.Error("Expected locking a locked document to fail.")
+		} else if _, ok := Cause(err).(DocumentLockedError); !ok {
+			t.Errorf("Expected DocumentLockedError. got %v.", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.items["user::1"].locked {
+		t.Error("Expected the document to be unlocked.")
+	}
+
+	// Documents are unlocked when fn fails or panics.
+	failure := errors.New("failure")
+	if err := store.WithLock("user::1", time.Second, func(database.Row) error { return failure }); err != failure {
+		t.Errorf("Expected the error of fn. got %v.", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to propagate.")
+			}
+		}()
+		store.WithLocks([]string{"user::2", "user::1"}, time.Second, func([]database.Row) error { panic("panic") })
+	}()
+	if fake.items["user::1"].locked || fake.items["user::2"].locked {
+		t.Error("Expected the documents to be unlocked.")
+	}
+
+	// Writing a locked document with the cas of its row unlocks it.
+	if err := store.WithLock("user::1", time.Second, func(row database.Row) error {
+		row.SetData(&User{Username: "changed"})
+		return store.ReplaceOne(row).Fault()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are locked in order, rows are passed in the order of keys.
+	var locked []string
+	store.Use(Before(func(call *Call) error {
+		if call.Method == "ReadOne" {
+			locked = append(locked, call.Args[0].(database.Row).GetKey())
+		}
+		return nil
+	}))
+	if err := store.WithLocks([]string{"user::2", "user::1"}, time.Second, func(rows []database.Row) error {
+		if rows[0].GetKey() != "user::2" || rows[1].GetKey() != "user::1" {
+			t.Errorf("Expected the rows in the order of the keys. got %s and %s.", rows[0].GetKey(), rows[1].GetKey())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 2 || locked[0] != "user::1" || locked[1] != "user::2" {
+		t.Errorf("Expected the keys to be locked in order. got %v.", locked)
+	}
+
+	// Failing to lock a document unlocks the others.
+	if err := store.WithLocks([]string{"user::1", "user::3"}, time.Second, func([]database.Row) error { return nil }); err == nil {
+		t.Error("Expected locking a missing document to fail.")
+	}
+	if fake.items["user::1"].locked {
+		t.Error("Expected the document to be unlocked.")
+	}
+
+	if err := store.WithLock("user::1", time.Minute, func(database.Row) error { return nil }); err == nil {
+		t.Error("Expected locks over 30s to be rejected.")
+	}
+}
+
+func TestCouchbaseStore_ReadLocked(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	users := NewRepository[User](store)
+	for _, id := range []string{"1", "2"} {
+		if _, err := users.Insert(id, User{Username: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock := store.NewRow("2")
+	lock.SetType("user")
+	lock.SetMeta(database.LOCK, 5)
+	rows, ok := store.Read("user::1", lock, "user::3")
+	if ok || len(rows) != 3 {
+		t.Fatalf("Expected the missing document to fail the read. got %d rows.", len(rows))
+	}
+	if rows[0].IsFaulted() || rows[0].GetKey() != "user::1" {
+		t.Errorf("Expected user::1. got %s: %v.", rows[0].GetKey(), rows[0].Fault())
+	}
+	if rows[1].IsFaulted() || rows[1].GetKey() != "user::2" || !fake.items["user::2"].locked {
+		t.Errorf("Expected user::2 to be locked. got %s: %v.", rows[1].GetKey(), rows[1].Fault())
+	}
+	if _, ok := rows[2].Fault().(database.NotFoundError); !ok {
+		t.Errorf("Expected NotFoundError. got %v.", rows[2].Fault())
+	}
+}
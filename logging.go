@@ -0,0 +1,132 @@
+package couchbase
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// LogOptions configures what a store logs and at which level.
+type LogOptions struct {
+	// SlowThreshold logs the calls lasting longer. Slow calls aren't logged when zero.
+	SlowThreshold time.Duration
+	// ConnectLevel is the level of connection events. Defaults to slog.LevelInfo.
+	ConnectLevel slog.Leveler
+	// SlowLevel is the level of slow calls. Defaults to slog.LevelWarn.
+	SlowLevel slog.Leveler
+	// RetryLevel is the level of retried operations. Defaults to slog.LevelInfo.
+	RetryLevel slog.Leveler
+	// FaultLevel is the level of faulted rows and failed queries. Defaults to slog.LevelWarn.
+	FaultLevel slog.Leveler
+	// LogPayloads adds the data of the documents to fault logs. Documents may hold personal
+	// data, so it is disabled by default.
+	LogPayloads bool
+}
+
+type logging struct {
+	logger *slog.Logger
+	opts   LogOptions
+}
+
+// defaultLogging is used for connection events and inherited by the stores opened afterwards.
+var defaultLogging *logging
+
+func newLogging(logger *slog.Logger, opts LogOptions) *logging {
+	if logger == nil {
+		return nil
+	}
+	if opts.ConnectLevel == nil {
+		opts.ConnectLevel = slog.LevelInfo
+	}
+	if opts.SlowLevel == nil {
+		opts.SlowLevel = slog.LevelWarn
+	}
+	if opts.RetryLevel == nil {
+		opts.RetryLevel = slog.LevelInfo
+	}
+	if opts.FaultLevel == nil {
+		opts.FaultLevel = slog.LevelWarn
+	}
+	return &logging{logger: logger, opts: opts}
+}
+
+// SetLogger logs the connections made by NewCouchbaseStore and the operations of the stores
+// opened afterwards to logger. Passing nil disables logging for new stores.
+func SetLogger(logger *slog.Logger, opts LogOptions) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLogging = newLogging(logger, opts)
+}
+
+// SetLogger logs the operations of the store to logger. Passing nil disables logging.
+func (c *CouchbaseStore) SetLogger(logger *slog.Logger, opts LogOptions) {
+	c.logging = newLogging(logger, opts)
+	c.compose()
+}
+
+func (l *logging) connected(host, bucketName string, err error) {
+	if l == nil {
+		return
+	}
+	if err != nil {
+		l.logger.LogAttrs(context.Background(), slog.LevelError, "couchbase: failed to open bucket",
+			slog.String("host", host), slog.String("bucket", bucketName), slog.Any("error", err))
+		return
+	}
+	l.logger.LogAttrs(context.Background(), l.opts.ConnectLevel.Level(), "couchbase: opened bucket",
+		slog.String("host", host), slog.String("bucket", bucketName))
+}
+
+func (l *logging) retried(op Operation, key string, attempt int, err error) {
+	l.logger.LogAttrs(context.Background(), l.opts.RetryLevel.Level(), "couchbase: retrying operation",
+		slog.String("operation", string(op)), slog.String("key", key),
+		slog.Int("attempt", attempt), slog.Any("error", err))
+}
+
+// middleware logs the slow calls and the faults of the calls made to a store.
+func (l *logging) middleware(next Handler) Handler {
+	return func(call *Call) error {
+		start := time.Now()
+		err := next(call)
+		elapsed := time.Since(start)
+
+		if l.opts.SlowThreshold > 0 && elapsed > l.opts.SlowThreshold {
+			attrs := []slog.Attr{
+				slog.String("method", call.Method),
+				slog.String("bucket", call.Bucket),
+				slog.Duration("duration", elapsed),
+			}
+			if call.Query != nil {
+				attrs = append(attrs, slog.String("statement", call.Query.GetStatement()))
+			} else {
+				attrs = append(attrs, slog.Int("size", len(call.Args)))
+			}
+			l.logger.LogAttrs(call.Context, l.opts.SlowLevel.Level(), "couchbase: slow operation", attrs...)
+		}
+
+		if err != nil {
+			l.logger.LogAttrs(call.Context, l.opts.FaultLevel.Level(), "couchbase: operation failed",
+				slog.String("method", call.Method), slog.String("bucket", call.Bucket),
+				slog.String("class", errorClass(err)), slog.Any("error", err))
+		}
+		for _, row := range call.Rows {
+			if !row.IsFaulted() {
+				continue
+			}
+			attrs := []slog.Attr{
+				slog.String("method", call.Method),
+				slog.String("bucket", call.Bucket),
+				slog.String("key", row.GetKey()),
+				slog.String("type", row.GetType()),
+				slog.String("class", errorClass(row.Fault())),
+				slog.Any("error", row.Fault()),
+			}
+			if l.opts.LogPayloads {
+				attrs = append(attrs, slog.Any("data", row.GetData()))
+			}
+			l.logger.LogAttrs(call.Context, l.opts.FaultLevel.Level(), "couchbase: operation faulted", attrs...)
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,78 @@
+package couchbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/couchbase/gocb"
+)
+
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		r := map[string]interface{}{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestCouchbaseStore_SetLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	store := newStore(newFakeBucket())
+	store.SetLogger(logger, LogOptions{})
+	store.SetRetryPolicy(&RetryPolicy{MaxAttempts: 2})
+
+	d := newDoc("1")
+	d.SetData(&User{Password: "secret"})
+	store.CreateOne(d)
+	store.CreateOne(d)
+	store.InjectFaults(NewFaultInjector(1, Fault{Ops: []Operation{OpGet}, Err: gocb.ErrTmpFail}))
+	store.ReadOne(d)
+
+	records := logRecords(t, buf)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records. got %d: %v.", len(records), records)
+	}
+
+	conflict, retry, temporary := records[0], records[1], records[2]
+	if conflict["class"] != "AlreadyExistsError" || conflict["key"] != "user::1" || conflict["level"] != "WARN" {
+		t.Errorf("Expected the conflict to be logged. got %v.", conflict)
+	}
+	if _, ok := conflict["data"]; ok {
+		t.Error("Expected payloads not to be logged by default.")
+	}
+	if retry["msg"] != "couchbase: retrying operation" || retry["operation"] != "get" {
+		t.Errorf("Expected the retry to be logged. got %v.", retry)
+	}
+	if temporary["class"] != "TemporaryError" {
+		t.Errorf("Expected TemporaryError to be logged. got %v.", temporary)
+	}
+}
+
+func TestCouchbaseStore_SetLoggerPayloads(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(buf, nil))
+
+	store := newStore(newFakeBucket())
+	store.SetLogger(logger, LogOptions{LogPayloads: true, FaultLevel: slog.LevelError})
+	store.ReadOne("missing")
+
+	records := logRecords(t, buf)
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record. got %d.", len(records))
+	}
+	if _, ok := records[0]["data"]; !ok {
+		t.Error("Expected the payload to be logged.")
+	}
+	if records[0]["level"] != "ERROR" {
+		t.Errorf("Expected level ERROR. got %v.", records[0]["level"])
+	}
+}
@@ -0,0 +1,213 @@
+package couchbase
+
+import (
+	"time"
+
+	"github.com/couchbase/gocb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Assert interface implementation
+var (
+	_ prometheus.Collector = (*Metrics)(nil)
+	_ bucket               = (*meteredBucket)(nil)
+	_ transcodable         = (*meteredValue)(nil)
+)
+
+// Metrics is a prometheus.Collector tracking the operations of the stores instrumented with it,
+// along with the stores and clusters opened by the process.
+type Metrics struct {
+	calls    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	batch    *prometheus.HistogramVec
+	faults   *prometheus.CounterVec
+	payload  *prometheus.HistogramVec
+	ratio    *prometheus.HistogramVec
+
+	stores   *prometheus.Desc
+	clusters *prometheus.Desc
+}
+
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operations_total",
+			Help:      "Store operations, by method.",
+		}, []string{"method"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of store operations, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		batch: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_batch_size",
+			Help:      "Documents per store operation, by method.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"method"}),
+		faults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Faulted rows and failed queries, by method and error type.",
+		}, []string{"method", "error"}),
+		payload: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "document_size_bytes",
+			Help:      "Size of the serialized documents written to and read from the cluster, by operation.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+		}, []string{"operation"}),
+		ratio: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "compression_ratio",
+			Help:      "Size of the data of compressed documents over their compressed size, by algorithm.",
+			Buckets:   []float64{1, 1.5, 2, 3, 5, 10, 20},
+		}, []string{"algorithm"}),
+		stores: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "open_stores"),
+			"Stores opened and not yet closed.", nil, nil),
+		clusters: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "open_clusters"),
+			"Clusters connected to.", nil, nil),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.calls.Describe(ch)
+	m.duration.Describe(ch)
+	m.batch.Describe(ch)
+	m.faults.Describe(ch)
+	m.payload.Describe(ch)
+	m.ratio.Describe(ch)
+	ch <- m.stores
+	ch <- m.clusters
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.calls.Collect(ch)
+	m.duration.Collect(ch)
+	m.batch.Collect(ch)
+	m.faults.Collect(ch)
+	m.payload.Collect(ch)
+	m.ratio.Collect(ch)
+
+	mu.Lock()
+	stores, clusters := openStores, len(clusters)
+	mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(m.stores, prometheus.GaugeValue, float64(stores))
+	ch <- prometheus.MustNewConstMetric(m.clusters, prometheus.GaugeValue, float64(clusters))
+}
+
+// Middleware returns the middleware observing the calls made to a store.
+// Use CouchbaseStore.Instrument to observe document sizes as well.
+func (m *Metrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) error {
+			start := time.Now()
+			err := next(call)
+
+			m.calls.WithLabelValues(call.Method).Inc()
+			m.duration.WithLabelValues(call.Method).Observe(time.Since(start).Seconds())
+			if call.Query == nil {
+				m.batch.WithLabelValues(call.Method).Observe(float64(len(call.Args)))
+			}
+
+			if err != nil {
+				m.faults.WithLabelValues(call.Method, errorClass(err)).Inc()
+			}
+			for _, row := range call.Rows {
+				if row.IsFaulted() {
+					m.faults.WithLabelValues(call.Method, errorClass(row.Fault())).Inc()
+				}
+			}
+			return err
+		}
+	}
+}
+
+// Instrument reports the operations of the store and the size of the documents it exchanges
+// with the cluster to m, in place of the metrics it reported to before. Passing nil stops
+// reporting.
+func (c *CouchbaseStore) Instrument(m *Metrics) {
+	c.metrics = m
+	c.compose()
+}
+
+// meteredBucket observes the size of the documents as they are serialized and deserialized.
+type meteredBucket struct {
+	bucket
+	metrics *Metrics
+}
+
+// meteredValue wraps a document, observing its size as it is encoded or decoded.
+type meteredValue struct {
+	value   interface{}
+	observe prometheus.Observer
+}
+
+func (v *meteredValue) encode() ([]byte, uint32, error) {
+	data, flags, err := transcoder{}.Encode(v.value)
+	if err == nil {
+		v.observe.Observe(float64(len(data)))
+	}
+	return data, flags, err
+}
+
+func (v *meteredValue) decode(data []byte, flags uint32) error {
+	v.observe.Observe(float64(len(data)))
+	return transcoder{}.Decode(data, flags, v.value)
+}
+
+func (b *meteredBucket) wrap(op Operation, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return &meteredValue{value: value, observe: b.metrics.payload.WithLabelValues(string(op))}
+}
+
+func (b *meteredBucket) Get(key string, valuePtr interface{}) (gocb.Cas, error) {
+	return b.bucket.Get(key, b.wrap(OpGet, valuePtr))
+}
+func (b *meteredBucket) GetAndLock(key string, lockTime uint32, valuePtr interface{}) (gocb.Cas, error) {
+	return b.bucket.GetAndLock(key, lockTime, b.wrap(OpGetAndLock, valuePtr))
+}
+func (b *meteredBucket) Insert(key string, value interface{}, expiry uint32) (gocb.Cas, error) {
+	return b.bucket.Insert(key, b.wrap(OpInsert, value), expiry)
+}
+func (b *meteredBucket) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	return b.bucket.Replace(key, b.wrap(OpReplace, value), cas, expiry)
+}
+
+func (b *meteredBucket) Do(ops []gocb.BulkOp) error {
+	values := make([]interface{}, len(ops))
+	for i, op := range ops {
+		switch o := op.(type) {
+		case *gocb.GetOp:
+			values[i], o.Value = o.Value, b.wrap(OpGet, o.Value)
+		case *gocb.InsertOp:
+			values[i], o.Value = o.Value, b.wrap(OpInsert, o.Value)
+		case *gocb.ReplaceOp:
+			values[i], o.Value = o.Value, b.wrap(OpReplace, o.Value)
+		case *gocb.UpsertOp:
+			values[i], o.Value = o.Value, b.wrap(OpUpsert, o.Value)
+		}
+	}
+
+	err := b.bucket.Do(ops)
+
+	for i, op := range ops {
+		switch o := op.(type) {
+		case *gocb.GetOp:
+			o.Value = values[i]
+		case *gocb.InsertOp:
+			o.Value = values[i]
+		case *gocb.ReplaceOp:
+			o.Value = values[i]
+		case *gocb.UpsertOp:
+			o.Value = values[i]
+		}
+	}
+	return err
+}
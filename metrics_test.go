@@ -0,0 +1,78 @@
+package couchbase
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gather(t *testing.T, m *Metrics) map[string]*dto.MetricFamily {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(m)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*dto.MetricFamily{}
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+	return byName
+}
+
+func TestCouchbaseStore_Instrument(t *testing.T) {
+	m := NewMetrics("couchbase")
+	store := newStore(newFakeBucket())
+	defer store.Close()
+	store.Instrument(m)
+	// Instrumenting again replaces the metrics rather than counting calls twice.
+	store.Instrument(m)
+
+	d1 := newDoc("1")
+	d1.SetData(&User{Username: "1"})
+	d2 := newDoc("2")
+	d2.SetData(&User{Username: "2"})
+	store.Create(d1, d2)
+	store.ReadOne(d1)
+	store.ReadOne("missing")
+
+	families := gather(t, m)
+
+	calls := families["couchbase_operations_total"]
+	if calls == nil || len(calls.GetMetric()) != 2 {
+		t.Fatalf("Expected operations of 2 methods. got %v.", calls)
+	}
+	var total float64
+	for _, metric := range calls.GetMetric() {
+		total += metric.GetCounter().GetValue()
+	}
+	if total != 3 {
+		t.Errorf("Expected 3 operations. got %v.", total)
+	}
+
+	faults := families["couchbase_errors_total"]
+	if faults == nil || len(faults.GetMetric()) != 1 {
+		t.Fatalf("Expected 1 error series. got %v.", faults)
+	}
+	for _, l := range faults.GetMetric()[0].GetLabel() {
+		if l.GetName() == "error" && l.GetValue() != "NotFoundError" {
+			t.Errorf("Expected NotFoundError. got %s.", l.GetValue())
+		}
+	}
+
+	sizes := map[string]uint64{}
+	for _, metric := range families["couchbase_document_size_bytes"].GetMetric() {
+		for _, l := range metric.GetLabel() {
+			sizes[l.GetValue()] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+	if sizes["insert"] != 2 || sizes["get"] != 1 {
+		t.Errorf("Expected 2 inserted and 1 read documents. got %v.", sizes)
+	}
+
+	if stores := families["couchbase_open_stores"]; stores == nil || stores.GetMetric()[0].GetGauge().GetValue() < 1 {
+		t.Errorf("Expected open stores to be reported. got %v.", stores)
+	}
+}
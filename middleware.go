@@ -0,0 +1,211 @@
+package couchbase
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/Tlantic/go-nosql"
+)
+
+// Call is a store operation travelling through the middleware chain.
+type Call struct {
+	// Context is the context the store is bound to, see CouchbaseStore.WithContext.
+	Context context.Context
+	// Bucket is the name of the bucket the store operates on.
+	Bucket string
+	// Method is the name of the store method called, e.g. "Create" or "ReadOne".
+	Method string
+	// Args are the values passed to the method. Middleware may replace or modify them before
+	// calling the next handler.
+	Args []interface{}
+	// Out is the value passed to ReadOneWithType.
+	Out interface{}
+	// Query is the query passed to Exec.
+	Query Query
+
+	// Rows are the rows returned by the method, one per argument, set once the call is handled.
+	Rows []Row
+	// Result is the result returned by Exec, set once the call is handled.
+	Result QueryResult
+}
+
+// Handler handles a call, setting its Rows or Result.
+type Handler func(call *Call) error
+
+// Middleware wraps the handling of every call made to a store. It may inspect and modify the
+// call before and after invoking next, or short-circuit it by returning an error without
+// invoking next. The error faults every row of the call, or is returned by Exec.
+type Middleware func(next Handler) Handler
+
+// Before returns a middleware running hook before a call is handled.
+// An error returned by the hook short-circuits the call.
+func Before(hook func(call *Call) error) Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) error {
+			if err := hook(call); err != nil {
+				return err
+			}
+			return next(call)
+		}
+	}
+}
+
+// After returns a middleware running hook once a call was handled.
+// An error returned by the hook faults the rows of the call.
+func After(hook func(call *Call) error) Middleware {
+	return func(next Handler) Handler {
+		return func(call *Call) error {
+			if err := next(call); err != nil {
+				return err
+			}
+			return hook(call)
+		}
+	}
+}
+
+// Use registers middleware on the store. The first middleware registered is the outermost.
+func (c *CouchbaseStore) Use(mw ...Middleware) {
+	// The slice is copied, as views share it with the store they come from.
+	middleware := make([]Middleware, 0, len(c.middleware)+len(mw))
+	c.middleware = append(append(middleware, c.middleware...), mw...)
+}
+
+func (c *CouchbaseStore) newCall(method string) *Call {
+	return &Call{Context: c.context(), Bucket: c.bucketName, Method: method}
+}
+
+// intercepted reports whether calls made to the store go through a middleware chain.
+func (c *CouchbaseStore) intercepted() bool {
+	return len(c.middleware) > 0 || c.metrics != nil || c.logging != nil
+}
+
+func (c *CouchbaseStore) handle(call *Call, h Handler) error {
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		h = c.middleware[i](h)
+	}
+	if c.metrics != nil {
+		h = c.metrics.Middleware()(h)
+	}
+	if c.logging != nil {
+		h = c.logging.middleware(h)
+	}
+	return h(call)
+}
+
+// rows returns the rows of a handled call, faulting them with the error it returned.
+func (call *Call) rows(err error) ([]Row, bool) {
+	if err != nil {
+		if call.Rows == nil {
+			call.Rows = make([]Row, len(call.Args))
+		}
+		for i, arg := range call.Args {
+			if i >= len(call.Rows) {
+				break
+			}
+			if call.Rows[i] == nil {
+				call.Rows[i] = faultedRow(arg, err)
+			} else if !call.Rows[i].IsFaulted() {
+				call.Rows[i] = faultedRow(call.Rows[i], err)
+			}
+		}
+	}
+
+	ok := true
+	for _, row := range call.Rows {
+		if row.IsFaulted() {
+			ok = false
+		}
+	}
+	return call.Rows, ok
+}
+
+// faultedRow returns a row describing x, faulted with err.
+func faultedRow(x interface{}, err error) Row {
+	doc := newDoc("")
+	switch value := x.(type) {
+	case string:
+		doc.key = value
+	case Row:
+		doc.key = value.GetKey()
+		doc.Id = value.GetId()
+		doc.Type = value.GetType()
+		doc.Data = value.GetData()
+		doc.mergeMetadata(value.Metadata())
+	case fmt.Stringer:
+		doc.key = value.String()
+	}
+	doc.fault = err
+	return doc
+}
+
+func (c *CouchbaseStore) bulk(method string, xs []interface{}, fn func(...interface{}) ([]Row, bool)) ([]Row, bool) {
+	if !c.intercepted() {
+		return c.wrapFaults(fn(xs...))
+	}
+
+	call := c.newCall(method)
+	call.Args = xs
+	err := c.handle(call, func(call *Call) error {
+		call.Rows, _ = fn(call.Args...)
+		return nil
+	})
+	return c.wrapFaults(call.rows(err))
+}
+
+func (c *CouchbaseStore) one(method string, x interface{}, fn func(interface{}) Row) Row {
+	if !c.intercepted() {
+		return c.wrapFault(fn(x))
+	}
+
+	call := c.newCall(method)
+	call.Args = []interface{}{x}
+	err := c.handle(call, func(call *Call) error {
+		call.Rows = make([]Row, len(call.Args))
+		for i, arg := range call.Args {
+			call.Rows[i] = fn(arg)
+		}
+		return nil
+	})
+	if rows, _ := call.rows(err); len(rows) > 0 {
+		return c.wrapFault(rows[0])
+	}
+	return c.wrapFault(faultedRow(x, InvalidArgsError{fmt.Errorf("%s: middleware removed the argument", method)}))
+}
+
+func (c *CouchbaseStore) typed(method string, x interface{}, out interface{}, fn func(interface{}, interface{}) Row) Row {
+	if !c.intercepted() {
+		return c.wrapFault(fn(x, out))
+	}
+
+	call := c.newCall(method)
+	call.Args = []interface{}{x}
+	call.Out = out
+	err := c.handle(call, func(call *Call) error {
+		call.Rows = make([]Row, len(call.Args))
+		for i, arg := range call.Args {
+			call.Rows[i] = fn(arg, call.Out)
+		}
+		return nil
+	})
+	if rows, _ := call.rows(err); len(rows) > 0 {
+		return c.wrapFault(rows[0])
+	}
+	return c.wrapFault(faultedRow(x, InvalidArgsError{fmt.Errorf("%s: middleware removed the argument", method)}))
+}
+
+func (c *CouchbaseStore) query(method string, q Query, fn func(Query) (QueryResult, error)) (QueryResult, error) {
+	if !c.intercepted() {
+		return fn(q)
+	}
+
+	call := c.newCall(method)
+	call.Query = q
+	err := c.handle(call, func(call *Call) (err error) {
+		call.Result, err = fn(call.Query)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return call.Result, nil
+}
@@ -0,0 +1,127 @@
+package couchbase
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+func TestCouchbaseStore_Use(t *testing.T) {
+	store := newStore(newFakeBucket())
+
+	var methods []string
+	store.Use(func(next Handler) Handler {
+		return func(call *Call) error {
+			methods = append(methods, call.Method)
+			return next(call)
+		}
+	}, Before(func(call *Call) error {
+		for _, arg := range call.Args {
+			if row, ok := arg.(database.Row); ok {
+				row.SetMeta("audit", "test")
+			}
+		}
+		return nil
+	}), After(func(call *Call) error {
+		for _, row := range call.Rows {
+			if !row.IsFaulted() && row.GetMeta("audit") != "test" {
+				t.Errorf("Expected %s rows to carry the audit meta.", call.Method)
+			}
+		}
+		return nil
+	}))
+
+	d1 := newDoc("1")
+	d1.SetData(&User{Username: "1"})
+	d2 := newDoc("2")
+	d2.SetData(&User{Username: "2"})
+
+	if rows, ok := store.Create(d1, d2); !ok {
+		t.Fatal(_firstFault(rows))
+	}
+	if row := store.ReadOneWithType(d1, &User{}); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if row.GetMeta("audit") != "test" {
+		t.Error("Expected the audit meta to be stored.")
+	}
+
+	expected := []string{"Create", "ReadOneWithType"}
+	if len(methods) != len(expected) {
+		t.Fatalf("Expected calls %v. got %v.", expected, methods)
+	}
+	for i, m := range expected {
+		if methods[i] != m {
+			t.Errorf("Expected calls %v. got %v.", expected, methods)
+		}
+	}
+}
+
+func TestCouchbaseStore_UseView(t *testing.T) {
+	store := newStore(newFakeBucket())
+	pass := Before(func(*Call) error { return nil })
+	// Used one at a time, the middleware leaves room in its slice for another.
+	store.Use(pass)
+	store.Use(pass)
+	store.Use(pass)
+
+	var viewed, stored int
+	view := store.WithContext(context.Background())
+	view.Use(Before(func(*Call) error {
+		viewed++
+		return nil
+	}))
+	store.Use(Before(func(*Call) error {
+		stored++
+		return nil
+	}))
+
+	view.ReadOne("missing")
+	if viewed != 1 || stored != 0 {
+		t.Errorf("Expected 1 call through the view only. got %d and %d.", viewed, stored)
+	}
+	store.ReadOne("missing")
+	if viewed != 1 || stored != 1 {
+		t.Errorf("Expected 1 call through the store only. got %d and %d.", viewed, stored)
+	}
+}
+
+func TestCouchbaseStore_UseShortCircuit(t *testing.T) {
+	store := newStore(newFakeBucket())
+
+	denied := errors.New("denied")
+	store.Use(Before(func(call *Call) error {
+		if call.Method == "Destroy" || call.Method == "Exec" {
+			return denied
+		}
+		return nil
+	}))
+
+	d := newDoc("1")
+	d.SetData(&User{})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+
+	rows, ok := store.Destroy(d, "missing")
+	if ok {
+		t.Fatal("Expected Destroy to fail.")
+	}
+	for _, row := range rows {
+		if row.Fault() != denied {
+			t.Errorf("Expected %v. got %+v.", denied, row.Fault())
+		}
+	}
+	if rows[0].GetKey() != d.GetKey() || rows[1].GetKey() != "missing" {
+		t.Error("Expected faulted rows to describe the arguments.")
+	}
+
+	if row := store.ReadOne(d); row.IsFaulted() {
+		t.Error("Expected the document not to be destroyed.", row.Fault())
+	}
+
+	if _, err := store.Exec(store.NewQuery("SELECT 1")); err != denied {
+		t.Errorf("Expected %v. got %+v.", denied, err)
+	}
+}
@@ -0,0 +1,128 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+// Migration upgrades the data of a document to the next schema version of its type.
+type Migration func(data json.RawMessage) (json.RawMessage, error)
+
+// Migrations holds the schema versions of the document types. Documents are stamped with the
+// latest version of their type when written, and migrated to it when read. Documents written
+// without a version are at version 1.
+type Migrations struct {
+	// WriteBack stores the documents migrated when read, guarded by the cas they were read with.
+	// Locked reads aren't written back.
+	WriteBack bool
+
+	locker sync.RWMutex
+	steps  map[string][]Migration
+}
+
+func NewMigrations() *Migrations {
+	return &Migrations{steps: map[string][]Migration{}}
+}
+
+// Register adds the migration upgrading the documents of type typ from version from. Migrations
+// of a type are registered in order, starting from version 1.
+func (m *Migrations) Register(typ string, from int, fn Migration) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	if latest := len(m.steps[typ]) + 1; from != latest {
+		return fmt.Errorf("couchbase: migration of %q from version %d registered at version %d", typ, from, latest)
+	}
+	m.steps[typ] = append(m.steps[typ], fn)
+	return nil
+}
+
+// Version returns the latest version of typ.
+func (m *Migrations) Version(typ string) int {
+	if m == nil {
+		return 0
+	}
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+	return len(m.steps[typ]) + 1
+}
+
+// migrate upgrades data of typ from version to the latest version, reporting whether it changed.
+func (m *Migrations) migrate(typ string, version int, data []byte) ([]byte, bool, error) {
+	m.locker.RLock()
+	steps := m.steps[typ]
+	m.locker.RUnlock()
+
+	if version < 1 {
+		version = 1
+	}
+	if version > len(steps)+1 {
+		return nil, false, fmt.Errorf("couchbase: %q document at version %d, latest known is %d", typ, version, len(steps)+1)
+	}
+
+	migrated := false
+	for _, step := range steps[version-1:] {
+		var err error
+		if data, err = step(data); err != nil {
+			return nil, false, err
+		}
+		migrated = true
+	}
+	return data, migrated, nil
+}
+
+// SetMigrations versions and migrates the documents of the store with m. Passing nil disables it.
+func (c *CouchbaseStore) SetMigrations(m *Migrations) {
+	c.versions = m
+}
+
+// writeBack stores the documents migrated when read, if the migrations ask for it, keeping their
+// expiry. A document changed since it was read, or whose expiry can't be fetched, keeps its
+// version and is migrated again by the next read.
+func (c *CouchbaseStore) writeBack(docs ...*doc) {
+	if c.versions == nil || !c.versions.WriteBack {
+		return
+	}
+
+	var upgraded []*doc
+	var ops []gocb.BulkOp
+	for _, d := range docs {
+		if !d.migrated || d.fault != nil {
+			continue
+		}
+		cas := makeCAS(d.GetMeta(database.CAS))
+		expiry, current, err := c.bucket.Expiry(d.GetKey())
+		if err != nil || current != cas {
+			continue
+		}
+
+		// Data read without a target holds the migrated bytes, which are stored as is.
+		value := d
+		if data, ok := d.Data.([]byte); ok {
+			cpy := *d
+			cpy.Data = json.RawMessage(data)
+			value = &cpy
+		}
+		upgraded = append(upgraded, d)
+		ops = append(ops, &gocb.ReplaceOp{
+			Key:    d.GetKey(),
+			Value:  value,
+			Cas:    cas,
+			Expiry: expiry,
+		})
+	}
+	if len(ops) == 0 || c.bucket.Do(ops) != nil {
+		return
+	}
+
+	for i, op := range ops {
+		if op := op.(*gocb.ReplaceOp); op.Err == nil {
+			upgraded[i].SetMeta(database.CAS, op.Cas)
+			upgraded[i].migrated = false
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package couchbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+// renameField returns a migration renaming a top-level data field.
+func renameField(from, to string) Migration {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		fields[to] = fields[from]
+		delete(fields, from)
+		return json.Marshal(fields)
+	}
+}
+
+func TestMigrations_Register(t *testing.T) {
+	m := NewMigrations()
+	if err := m.Register("user", 2, renameField("name", "username")); err == nil {
+		t.Error("Expected migrations registered out of order to fail.")
+	}
+	if err := m.Register("user", 1, renameField("name", "username")); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.Version("user"); v != 2 {
+		t.Errorf("Expected version 2. got %d.", v)
+	}
+	if v := m.Version("order"); v != 1 {
+		t.Errorf("Expected unmigrated types at version 1. got %d.", v)
+	}
+	if _, _, err := m.migrate("user", 3, []byte(`{}`)); err == nil {
+		t.Error("Expected documents from a newer version to fail.")
+	}
+}
+
+func TestCouchbaseStore_SetMigrations(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+
+	// Documents written before versioning are at version 1.
+	for _, id := range []string{"1", "2"} {
+		d := store.NewRow(id)
+		d.SetType("user")
+		d.SetData(map[string]string{"name": "user" + id, "pass": "password"})
+		d.SetExpiry(3600)
+		if row := store.CreateOne(d); row.IsFaulted() {
+			t.Fatal(row.Fault())
+		}
+	}
+
+	m := NewMigrations()
+	m.Register("user", 1, renameField("name", "username"))
+	m.Register("user", 2, renameField("pass", "password"))
+	store.SetMigrations(m)
+
+	u := &User{}
+	if row := store.ReadOneWithType("user::1", u); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if u.Username != "user1" || u.Password != "password" {
+		t.Errorf("Expected the document to be migrated. got %+v.", u)
+	}
+	if bytes.Contains(fake.items["user::1"].value, []byte(`"_version"`)) {
+		t.Errorf("Expected migrated documents not to be written back. got %s.", fake.items["user::1"].value)
+	}
+
+	m.WriteBack = true
+	rows, ok := store.Read("user::1", "user::2")
+	if !ok {
+		t.Fatal(_firstFault(rows))
+	}
+	for _, key := range []string{"user::1", "user::2"} {
+		value := fake.items[key].value
+		if !bytes.Contains(value, []byte(`"_version":3`)) || !bytes.Contains(value, []byte(`"username"`)) {
+			t.Errorf("Expected %s to be written back at version 3. got %s.", key, value)
+		}
+		if expiry := fake.items[key].expiry; expiry != 3600 {
+			t.Errorf("Expected %s to keep its expiry. got %d.", key, expiry)
+		}
+	}
+	if rows[0].GetMeta(database.CAS) != fake.items["user::1"].cas {
+		t.Errorf("Expected the cas of the upgraded document. got %v.", rows[0].GetMeta(database.CAS))
+	}
+
+	// Upgraded documents are read as is.
+	u = &User{}
+	if row := store.ReadOneWithType("user::2", u); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if u.Username != "user2" {
+		t.Errorf("Expected username user2. got %+v.", u)
+	}
+}
@@ -0,0 +1,74 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+// DefaultMutateAttempts bounds the attempts made by Mutate and Transaction unless set with
+// SetMutateAttempts.
+const DefaultMutateAttempts = 10
+
+// SetMutateAttempts bounds the attempts made by Mutate and Transaction to modify documents changing
+// concurrently, the first one included. Zero restores DefaultMutateAttempts.
+func (c *CouchbaseStore) SetMutateAttempts(n int) {
+	c.mutateAttempts = n
+}
+
+// Mutate reads the document at key, lets fn modify its row and replaces the document with the
+// cas it was read with. When the document changed in between, it is read and modified again,
+// until the attempts are exhausted or the context of the store is done. fn may thus run several
+// times and must only change the row. An error returned by fn faults the row, leaving the document
+// untouched. The data of the row is the document as read by ReadOne. The document keeps its
+// expiry: the TTL meta of the row holds it as a Unix time, fn may change it.
+func (c *CouchbaseStore) Mutate(key string, fn func(row database.Row) error) database.Row {
+	return c.mutate(key, nil, fn)
+}
+
+// mutate runs Mutate, reading the document into the value returned by out on every attempt, if set.
+func (c *CouchbaseStore) mutate(key string, out func() interface{}, fn func(row database.Row) error) database.Row {
+	attempts := c.mutateAttempts
+	if attempts <= 0 {
+		attempts = DefaultMutateAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		var row database.Row
+		if out == nil {
+			row = c.ReadOne(key)
+		} else {
+			row = c.ReadOneWithType(key, out())
+		}
+		if row.IsFaulted() {
+			return row
+		}
+		// A document changed between the read and the lookup conflicts with the replacement.
+		expiry, _, err := c.bucket.Expiry(row.GetKey())
+		if err != nil {
+			return c.wrapFault(faultedRow(row, makeGetError(err)))
+		}
+		if expiry != 0 {
+			row.SetMeta(database.TTL, expiry)
+		}
+
+		if err := fn(row); err != nil {
+			return faultedRow(row, err)
+		}
+		row.SetMeta(database.UPDATEDON, time.Now().UTC())
+
+		// Data read without a target holds the bytes of the document, which are stored as is.
+		data, raw := row.GetData().([]byte)
+		if raw {
+			row.SetData(json.RawMessage(data))
+		}
+		row = c.ReplaceOne(row)
+		if raw {
+			row.SetData(data)
+		}
+		if !isCASConflict(row.Fault()) || attempt >= attempts || c.context().Err() != nil {
+			return row
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+func TestCouchbaseStore_Mutate(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	users := NewRepository[User](store)
+	if _, err := users.Insert("1", User{Username: "username"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A concurrent writer changes the document during the first attempt.
+	attempts := 0
+	row := store.Mutate("user::1", func(row database.Row) error {
+		attempts++
+		if attempts == 1 {
+			if _, err := users.Upsert("1", User{Username: "concurrent"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		u := User{}
+		if err := json.Unmarshal(row.GetData().([]byte), &u); err != nil {
+			return err
+		}
+		u.Password = u.Username
+		row.SetData(&u)
+		return nil
+	})
+	if row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if attempts != 2 {
+		t.Errorf("Expected the conflict to be retried once. got %d attempts.", attempts)
+	}
+	if u, _, _ := users.Get("1"); u.Password != "concurrent" {
+		t.Errorf("Expected the concurrent write to be kept. got %+v.", u)
+	}
+
+	// The attempts are bounded.
+	store.SetMutateAttempts(3)
+	attempts = 0
+	_, _, err := users.Mutate("1", func(u *User) error {
+		attempts++
+		_, err := users.Upsert("1", *u)
+		return err
+	})
+	if _, ok := Cause(err).(CASMismatchError); !ok {
+		t.Errorf("Expected CASMismatchError. got %v.", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts. got %d.", attempts)
+	}
+
+	// Errors returned by fn leave the document untouched.
+	failure := errors.New("failure")
+	if _, _, err := users.Mutate("1", func(u *User) error {
+		u.Username = "changed"
+		return failure
+	}); err != failure {
+		t.Errorf("Expected the error of fn. got %v.", err)
+	}
+
+	// The document keeps its expiry.
+	fake.items["user::1"].expiry = 3600
+	if u, meta, err := users.Mutate("1", func(u *User) error {
+		u.Username = "changed"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if u.Username != "changed" || meta.Cas == 0 {
+		t.Errorf("Expected the modified document. got %+v.", u)
+	} else if expiry := fake.items["user::1"].expiry; expiry != 3600 {
+		t.Errorf("Expected the document to keep its expiry. got %d.", expiry)
+	}
+
+	// Changing only the TTL stores the document as read.
+	row = store.Mutate("user::1", func(row database.Row) error {
+		row.SetMeta(database.TTL, uint32(7200))
+		return nil
+	})
+	if row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if u, _, err := users.Get("1"); err != nil {
+		t.Fatal(err)
+	} else if u.Username != "changed" {
+		t.Errorf("Expected the document to be stored as read. got %+v.", u)
+	}
+	if expiry := fake.items["user::1"].expiry; expiry != 7200 {
+		t.Errorf("Expected the document to expire as set. got %d.", expiry)
+	}
+	if _, ok := row.GetData().([]byte); !ok {
+		t.Errorf("Expected the data of the row as bytes. got %T.", row.GetData())
+	}
+
+	if row := store.Mutate("user::2", func(database.Row) error { return nil }); row.IsFaulted() {
+		if _, ok := row.Fault().(database.NotFoundError); !ok {
+			t.Errorf("Expected NotFoundError. got %v.", row.Fault())
+		}
+	} else {
+		t.Error("Expected mutating a missing document to fail.")
+	}
+}
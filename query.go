@@ -56,9 +56,14 @@ type queryResult struct {
 	data   [][]byte
 }
 
-func newQueryResult(q database.Query, r gocb.QueryResults) *queryResult {
+// newQueryResult reads the rows of r. Rows holding documents stored by codec are decoded with
+// it and encoded in the layout of EnvelopeCodec, see resultCodec. They are kept as is when codec is nil.
+func newQueryResult(q database.Query, r gocb.QueryResults, codec Codec) *queryResult {
 	data := make([][]byte, 0)
 	for b := r.NextBytes(); b != nil; b = r.NextBytes() {
+		if codec != nil {
+			b = envelopeRow(codec, b)
+		}
 		data = append(data, b)
 	}
 	return &queryResult{
@@ -169,3 +174,47 @@ func (q *queryResult) Close() error {
 	q.data = nil
 	return nil
 }
+
+// envelopeRow returns row with the documents it holds, as a whole or under their alias as selected
+// with `SELECT * FROM b`, decoded with codec and encoded in the layout of EnvelopeCodec. Other rows,
+// such as projections and aggregates, are returned as is, even when they select _uId or _type.
+func envelopeRow(codec Codec, row []byte) []byte {
+	if doc, ok := reencode(codec, row); ok {
+		return doc
+	}
+
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal(row, &fields) != nil {
+		return row
+	}
+	changed := false
+	for name, value := range fields {
+		if doc, ok := reencode(codec, value); ok {
+			fields[name] = doc
+			changed = true
+		}
+	}
+	if !changed {
+		return row
+	}
+	if out, err := json.Marshal(fields); err == nil {
+		return out
+	}
+	return row
+}
+
+// reencode decodes data with codec and encodes it with EnvelopeCodec. It fails when data isn't a
+// whole document, decoding without an id, type or meta, such as an aggregate grouped by _type.
+func reencode(codec Codec, data []byte) ([]byte, bool) {
+	e := &Envelope{}
+	if err := codec.Decode(data, e); err != nil || (e.Id == "" && e.Type == "") || len(e.Meta) == 0 {
+		return nil, false
+	}
+	raw, _ := e.Data.([]byte)
+	if raw == nil {
+		raw = []byte("null")
+	}
+	e.Data = json.RawMessage(raw)
+	out, err := EnvelopeCodec{}.Encode(e)
+	return out, err == nil
+}
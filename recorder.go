@@ -0,0 +1,486 @@
+package couchbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+// Assert interface implementation
+var (
+	_ bucket            = (*recorder)(nil)
+	_ bucket            = (*replayer)(nil)
+	_ gocb.QueryResults = (*replayResults)(nil)
+)
+
+// cassetteErrors are the gocb errors restored by identity when a session is replayed.
+var cassetteErrors = []error{
+	gocb.ErrKeyExists,
+	gocb.ErrKeyNotFound,
+	gocb.ErrTooBig,
+	gocb.ErrNotStored,
+	gocb.ErrTmpFail,
+	gocb.ErrTimeout,
+}
+
+// interaction is one recorded request to the cluster and its response.
+type interaction struct {
+	Op    Operation         `json:"op"`
+	Key   string            `json:"key,omitempty"`
+	Cas   gocb.Cas          `json:"cas,omitempty"`
+	Value json.RawMessage   `json:"value,omitempty"`
+	Data  []byte            `json:"data,omitempty"`
+	Flags uint32            `json:"flags,omitempty"`
+	Count uint64            `json:"count,omitempty"`
+	Rows  []json.RawMessage `json:"rows,omitempty"`
+	Err   string            `json:"error,omitempty"`
+	Ops   []interaction     `json:"ops,omitempty"`
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (i *interaction) fault() error {
+	if i.Err == "" {
+		return nil
+	}
+	for _, err := range cassetteErrors {
+		if err.Error() == i.Err {
+			return err
+		}
+	}
+	return errors.New(i.Err)
+}
+
+// setValue records a fetched value. JSON values are kept readable, others are base64 encoded.
+func (i *interaction) setValue(v *rawValue) {
+	if v == nil || v.data == nil {
+		return
+	}
+	i.Flags = v.flags
+	switch v.flags & flagsFormatMask {
+	case 0, flagsJSON:
+		i.Value = v.data
+	default:
+		i.Data = v.data
+	}
+}
+
+// setWritten records a written value, encoded with t like the bucket stores it.
+func (i *interaction) setWritten(t gocb.Transcoder, value interface{}) {
+	if value == nil || t == nil {
+		return
+	}
+	if data, flags, err := t.Encode(value); err == nil {
+		i.setValue(&rawValue{data: data, flags: flags})
+	}
+}
+
+// written reports whether value, encoded with t, is the value recorded as written. Sessions
+// recorded without the value written accept any. JSON values are compared without the ids and
+// timestamps of documents, which vary between runs.
+func (i *interaction) written(t gocb.Transcoder, value interface{}) bool {
+	if (i.Value == nil && i.Data == nil) || value == nil || t == nil {
+		return true
+	}
+	data, flags, err := t.Encode(value)
+	if err != nil || flags != i.Flags {
+		return false
+	}
+	if i.Data != nil {
+		return bytes.Equal(data, i.Data)
+	}
+	return bytes.Equal(stableJSON(data), stableJSON(i.Value))
+}
+
+// stableJSON returns a JSON document without the fields varying between runs: its id and the
+// timestamps of its meta, whichever codec stored it. Other values are returned as is.
+func stableJSON(data []byte) []byte {
+	fields := map[string]interface{}{}
+	if json.Unmarshal(data, &fields) != nil {
+		return data
+	}
+	delete(fields, flatId)
+	for _, name := range []string{"meta", flatMeta} {
+		if meta, ok := fields[name].(map[string]interface{}); ok {
+			delete(meta, database.CREATEDON)
+			delete(meta, database.UPDATEDON)
+		}
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// value returns the recorded value.
+func (i *interaction) value() *rawValue {
+	if i.Data != nil {
+		return &rawValue{data: i.Data, flags: i.Flags}
+	}
+	return &rawValue{data: i.Value, flags: i.Flags}
+}
+
+// decode stores a recorded value in valuePtr with the transcoder of the store.
+func decode(t gocb.Transcoder, v *rawValue, valuePtr interface{}) error {
+	if v.data == nil || valuePtr == nil {
+		return nil
+	}
+	return t.Decode(v.data, v.flags, valuePtr)
+}
+
+// NewRecordingStore connects like NewCouchbaseStore and records every KV operation and N1QL
+// response exchanged with the cluster, along with the values written. The session is written to path when the store is closed.
+func NewRecordingStore(host, bucketName, bucketPassword, path string) (*CouchbaseStore, error) {
+	b, err := openBucket(host, bucketName, bucketPassword)
+	if err != nil {
+		return nil, err
+	}
+	return newStore(&recorder{bucket: b, path: path}), nil
+}
+
+// NewReplayStore returns a store that answers every operation from the session recorded at path,
+// without connecting to a cluster. Operations must be issued in the order they were recorded and
+// write the values recorded, ids and timestamps aside, or they fault.
+func NewReplayStore(path string) (*CouchbaseStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &replayer{keys: map[string]string{}}
+	if err := json.Unmarshal(data, &r.tape); err != nil {
+		return nil, err
+	}
+	return newStore(r), nil
+}
+
+type recorder struct {
+	bucket
+	path       string
+	transcoder gocb.Transcoder
+
+	locker sync.Mutex
+	tape   []interaction
+}
+
+func (r *recorder) record(i interaction) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.tape = append(r.tape, i)
+}
+
+// SetTranscoder decodes the values fetched by the store with t. The bucket fetches them raw.
+func (r *recorder) SetTranscoder(t gocb.Transcoder) {
+	r.transcoder = t
+	r.bucket.SetTranscoder(t)
+}
+
+func (r *recorder) read(op Operation, key string, valuePtr interface{}, get func(*rawValue) (gocb.Cas, error)) (gocb.Cas, error) {
+	value := &rawValue{}
+	cas, err := get(value)
+	if err == nil {
+		err = decode(r.transcoder, value, valuePtr)
+	}
+	i := interaction{Op: op, Key: key, Cas: cas, Err: errString(err)}
+	i.setValue(value)
+	r.record(i)
+	return cas, err
+}
+func (r *recorder) write(op Operation, key string, value interface{}, cas gocb.Cas, err error) (gocb.Cas, error) {
+	i := interaction{Op: op, Key: key, Cas: cas, Err: errString(err)}
+	i.setWritten(r.transcoder, value)
+	r.record(i)
+	return cas, err
+}
+
+func (r *recorder) Get(key string, valuePtr interface{}) (gocb.Cas, error) {
+	return r.read(OpGet, key, valuePtr, func(value *rawValue) (gocb.Cas, error) {
+		return r.bucket.Get(key, value)
+	})
+}
+func (r *recorder) GetAndLock(key string, lockTime uint32, valuePtr interface{}) (gocb.Cas, error) {
+	return r.read(OpGetAndLock, key, valuePtr, func(value *rawValue) (gocb.Cas, error) {
+		return r.bucket.GetAndLock(key, lockTime, value)
+	})
+}
+func (r *recorder) Unlock(key string, cas gocb.Cas) (gocb.Cas, error) {
+	cas, err := r.bucket.Unlock(key, cas)
+	return r.write(OpUnlock, key, nil, cas, err)
+}
+func (r *recorder) Touch(key string, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	cas, err := r.bucket.Touch(key, cas, expiry)
+	return r.write(OpTouch, key, nil, cas, err)
+}
+func (r *recorder) Insert(key string, value interface{}, expiry uint32) (gocb.Cas, error) {
+	cas, err := r.bucket.Insert(key, value, expiry)
+	return r.write(OpInsert, key, value, cas, err)
+}
+func (r *recorder) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	cas, err := r.bucket.Replace(key, value, cas, expiry)
+	return r.write(OpReplace, key, value, cas, err)
+}
+func (r *recorder) Remove(key string, cas gocb.Cas) (gocb.Cas, error) {
+	cas, err := r.bucket.Remove(key, cas)
+	return r.write(OpRemove, key, nil, cas, err)
+}
+func (r *recorder) Counter(key string, delta, initial int64, expiry uint32) (uint64, gocb.Cas, error) {
+	value, cas, err := r.bucket.Counter(key, delta, initial, expiry)
+	r.record(interaction{Op: OpCounter, Key: key, Cas: cas, Count: value, Err: errString(err)})
+	return value, cas, err
+}
+
+func (r *recorder) Expiry(key string) (uint32, gocb.Cas, error) {
+	expiry, cas, err := r.bucket.Expiry(key)
+	r.record(interaction{Op: OpExpiry, Key: key, Cas: cas, Count: uint64(expiry), Err: errString(err)})
+	return expiry, cas, err
+}
+
+func (r *recorder) Do(ops []gocb.BulkOp) error {
+
+	// Capture the raw documents fetched by get ops and decode them once they are recorded.
+	values := make([]*rawValue, len(ops))
+	targets := make([]interface{}, len(ops))
+	for i, op := range ops {
+		if get, ok := op.(*gocb.GetOp); ok {
+			targets[i], values[i] = get.Value, &rawValue{}
+			get.Value = values[i]
+		}
+	}
+
+	err := r.bucket.Do(ops)
+
+	bulk := interaction{Op: OpBulk, Err: errString(err), Ops: make([]interaction, len(ops))}
+	for i, op := range ops {
+		name, key := bulkOpKey(op)
+		cas, opErr := bulkOpResult(op)
+		if get, ok := op.(*gocb.GetOp); ok {
+			get.Value = targets[i]
+			if opErr == nil {
+				if get.Err = decode(r.transcoder, values[i], targets[i]); get.Err != nil {
+					opErr = get.Err
+				}
+			}
+		}
+		bulk.Ops[i] = interaction{Op: name, Key: key, Cas: cas, Err: errString(opErr)}
+		bulk.Ops[i].setValue(values[i])
+		bulk.Ops[i].setWritten(r.transcoder, bulkOpValue(op))
+	}
+	r.record(bulk)
+
+	return err
+}
+
+func (r *recorder) ExecuteN1qlQuery(q *gocb.N1qlQuery, params interface{}) (gocb.QueryResults, error) {
+	results, err := r.bucket.ExecuteN1qlQuery(q, params)
+	if err != nil {
+		r.record(interaction{Op: OpQuery, Err: errString(err)})
+		return nil, err
+	}
+
+	i := interaction{Op: OpQuery}
+	for b := results.NextBytes(); b != nil; b = results.NextBytes() {
+		i.Rows = append(i.Rows, b)
+	}
+	err = results.Close()
+	i.Err = errString(err)
+	r.record(i)
+
+	return &replayResults{rows: i.Rows, err: err}, nil
+}
+
+// Close writes the recorded session to disk and closes the underlying bucket.
+func (r *recorder) Close() error {
+	r.locker.Lock()
+	data, err := json.MarshalIndent(r.tape, "", "  ")
+	r.locker.Unlock()
+
+	if err == nil {
+		err = ioutil.WriteFile(r.path, data, 0644)
+	}
+	if cerr := r.bucket.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replayer answers operations from a recorded session. Keys generated at random by a test
+// differ between runs, so every recorded key is bound to the first live key seen in its place.
+type replayer struct {
+	locker     sync.Mutex
+	tape       []interaction
+	keys       map[string]string
+	transcoder gocb.Transcoder
+}
+
+func (r *replayer) SetTranscoder(t gocb.Transcoder) {
+	r.transcoder = t
+}
+
+func (r *replayer) next(op Operation, key string) (interaction, error) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if len(r.tape) == 0 {
+		return interaction{}, fmt.Errorf("replay: unexpected %s %q, recorded session is exhausted", op, key)
+	}
+
+	i := r.tape[0]
+	if i.Op != op {
+		return interaction{}, fmt.Errorf("replay: unexpected %s %q, recorded %s %q", op, key, i.Op, i.Key)
+	}
+	if err := r.bind(i, key); err != nil {
+		return interaction{}, err
+	}
+
+	r.tape = r.tape[1:]
+	return i, nil
+}
+func (r *replayer) bind(i interaction, key string) error {
+	if live, ok := r.keys[i.Key]; !ok {
+		r.keys[i.Key] = key
+	} else if live != key {
+		return fmt.Errorf("replay: unexpected %s %q, recorded key %q was replayed as %q", i.Op, key, i.Key, live)
+	}
+	return nil
+}
+
+func (r *replayer) read(op Operation, key string, valuePtr interface{}) (gocb.Cas, error) {
+	i, err := r.next(op, key)
+	if err != nil {
+		return 0, err
+	}
+	if err := i.fault(); err != nil {
+		return i.Cas, err
+	}
+	return i.Cas, decode(r.transcoder, i.value(), valuePtr)
+}
+func (r *replayer) write(op Operation, key string, value interface{}) (gocb.Cas, error) {
+	i, err := r.next(op, key)
+	if err != nil {
+		return 0, err
+	}
+	if !i.written(r.transcoder, value) {
+		return 0, fmt.Errorf("replay: unexpected %s %q, the value written differs from the recorded one", op, key)
+	}
+	return i.Cas, i.fault()
+}
+
+func (r *replayer) Get(key string, valuePtr interface{}) (gocb.Cas, error) {
+	return r.read(OpGet, key, valuePtr)
+}
+func (r *replayer) GetAndLock(key string, lockTime uint32, valuePtr interface{}) (gocb.Cas, error) {
+	return r.read(OpGetAndLock, key, valuePtr)
+}
+func (r *replayer) Unlock(key string, cas gocb.Cas) (gocb.Cas, error) {
+	return r.write(OpUnlock, key, nil)
+}
+func (r *replayer) Touch(key string, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	return r.write(OpTouch, key, nil)
+}
+func (r *replayer) Insert(key string, value interface{}, expiry uint32) (gocb.Cas, error) {
+	return r.write(OpInsert, key, value)
+}
+func (r *replayer) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	return r.write(OpReplace, key, value)
+}
+func (r *replayer) Remove(key string, cas gocb.Cas) (gocb.Cas, error) {
+	return r.write(OpRemove, key, nil)
+}
+func (r *replayer) Counter(key string, delta, initial int64, expiry uint32) (uint64, gocb.Cas, error) {
+	i, err := r.next(OpCounter, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return i.Count, i.Cas, i.fault()
+}
+
+func (r *replayer) Expiry(key string) (uint32, gocb.Cas, error) {
+	i, err := r.next(OpExpiry, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(i.Count), i.Cas, i.fault()
+}
+
+func (r *replayer) Do(ops []gocb.BulkOp) error {
+	bulk, err := r.next(OpBulk, "")
+	if err != nil {
+		return err
+	}
+	if len(bulk.Ops) != len(ops) {
+		return fmt.Errorf("replay: unexpected bulk of %d ops, recorded %d", len(ops), len(bulk.Ops))
+	}
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	for n, op := range ops {
+		i := bulk.Ops[n]
+		name, key := bulkOpKey(op)
+		if name != i.Op {
+			return fmt.Errorf("replay: unexpected %s %q in bulk, recorded %s %q", name, key, i.Op, i.Key)
+		}
+		if err := r.bind(i, key); err != nil {
+			return err
+		}
+		if !i.written(r.transcoder, bulkOpValue(op)) {
+			return fmt.Errorf("replay: unexpected %s %q in bulk, the value written differs from the recorded one", name, key)
+		}
+
+		opErr := i.fault()
+		if get, ok := op.(*gocb.GetOp); ok && opErr == nil {
+			opErr = decode(r.transcoder, i.value(), get.Value)
+		}
+		setBulkOpResult(op, i.Cas, opErr)
+	}
+
+	return bulk.fault()
+}
+
+func (r *replayer) ExecuteN1qlQuery(q *gocb.N1qlQuery, params interface{}) (gocb.QueryResults, error) {
+	i, err := r.next(OpQuery, "")
+	if err != nil {
+		return nil, err
+	}
+	if i.Rows == nil {
+		if err := i.fault(); err != nil {
+			return nil, err
+		}
+	}
+	return &replayResults{rows: i.Rows, err: i.fault()}, nil
+}
+
+func (r *replayer) Close() error {
+	return nil
+}
+
+// replayResults serves buffered N1QL rows. Only the methods read by the store are implemented.
+type replayResults struct {
+	gocb.QueryResults
+	rows []json.RawMessage
+	err  error
+}
+
+func (r *replayResults) NextBytes() []byte {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	var row []byte
+	row, r.rows = r.rows[0], r.rows[1:]
+	return row
+}
+
+func (r *replayResults) Close() error {
+	return r.err
+}
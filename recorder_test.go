@@ -0,0 +1,144 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+func TestRecorder_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "couchbase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	golden := filepath.Join(dir, "session.json")
+
+	fake := newFakeBucket()
+	fake.rows = []json.RawMessage{[]byte(`{"n":1}`), []byte(`{"n":2}`)}
+	store := newStore(&recorder{bucket: fake, path: golden})
+
+	d1 := newDoc("1")
+	d1.SetType("user")
+	d1.SetData(&User{Username: "1"})
+	d2 := newDoc("2")
+	d2.SetType("user")
+	d2.SetData(&User{Username: "2"})
+
+	if rows, ok := store.Create(d1, d2); !ok {
+		t.Fatal(_firstFault(rows))
+	}
+	created := store.ReadOne(d1.GetKey())
+	store.ReadOne("missing")
+	if _, err := store.Exec(store.NewQuery("SELECT 1")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Replay the session with fresh ids, as a test generating random keys would.
+	store, err = NewReplayStore(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	r1 := newDoc("3")
+	r1.SetType("user")
+	r1.SetData(&User{Username: "1"})
+	r2 := newDoc("4")
+	r2.SetType("user")
+	r2.SetData(&User{Username: "2"})
+
+	if rows, ok := store.Create(r1, r2); !ok {
+		t.Fatal(_firstFault(rows))
+	}
+
+	u := &User{}
+	if row := store.ReadOneWithType(r1.GetKey(), u); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if row.GetMeta(database.CAS) != created.GetMeta(database.CAS) {
+		t.Errorf("Expected cas %v. got %v.", created.GetMeta(database.CAS), row.GetMeta(database.CAS))
+	} else if u.Username != "1" {
+		t.Errorf("Expected username 1. got %s.", u.Username)
+	}
+
+	if row := store.ReadOne("missing"); !row.IsFaulted() {
+		t.Error("Expected NotFoundError. got nil.")
+	} else if _, ok := row.Fault().(database.NotFoundError); !ok {
+		t.Errorf("Expected NotFoundError. got %+v.", row.Fault())
+	}
+
+	if res, err := store.Exec(store.NewQuery("SELECT 1")); err != nil {
+		t.Fatal(err)
+	} else if n := len(res.Map(func(int, []byte) interface{} { return nil })); n != 2 {
+		t.Errorf("Expected 2 rows. got %d.", n)
+	}
+
+	// Operations beyond the recorded session fault.
+	if row := store.ReadOne(r1.GetKey()); !row.IsFaulted() {
+		t.Error("Expected the exhausted session to fault.")
+	}
+}
+
+func TestRecorder_ReplayMismatch(t *testing.T) {
+	r := &replayer{
+		keys: map[string]string{},
+		tape: []interaction{{Op: OpGet, Key: "a"}, {Op: OpGet, Key: "a"}},
+	}
+
+	if _, err := r.Remove("a", 0); err == nil {
+		t.Error("Expected an error replaying remove in the place of get.")
+	}
+	if _, err := r.Get("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get("c", nil); err == nil {
+		t.Error("Expected an error replaying key c in the place of b.")
+	}
+}
+
+func TestRecorder_ReplayChangedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "couchbase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	golden := filepath.Join(dir, "session.json")
+
+	store := newStore(&recorder{bucket: newFakeBucket(), path: golden})
+	d := newDoc("1")
+	d.SetType("user")
+	d.SetData(&User{Username: "1"})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	store.Close()
+
+	// The same write replays, with a fresh id and timestamps.
+	store, err = NewReplayStore(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = newDoc("2")
+	d.SetType("user")
+	d.SetData(&User{Username: "1"})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+
+	// A changed write faults.
+	store, err = NewReplayStore(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = newDoc("1")
+	d.SetType("user")
+	d.SetData(&User{Username: "changed"})
+	if row := store.CreateOne(d); !row.IsFaulted() {
+		t.Error("Expected replaying a changed write to fault.")
+	}
+}
@@ -0,0 +1,161 @@
+package couchbase
+
+import (
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+// Meta is the metadata of a document handled by a Repository.
+type Meta struct {
+	Key       string
+	Cas       gocb.Cas
+	CreatedOn *time.Time
+	UpdatedOn *time.Time
+	// Values holds every metadata of the document.
+	Values map[string]interface{}
+}
+
+func metaOf(row database.Row) Meta {
+	return Meta{
+		Key:       row.GetKey(),
+		Cas:       makeCAS(row.GetMeta(database.CAS)),
+		CreatedOn: row.CreatedOn(),
+		UpdatedOn: row.UpdatedOn(),
+		Values:    row.Metadata(),
+	}
+}
+
+// Item is a document of a Repository read among others, or the error reading it.
+type Item[T any] struct {
+	Value T
+	Meta  Meta
+	Err   error
+}
+
+// Repository reads and writes the documents of a store holding data of type T, a struct.
+// Their type and keys are derived from T as rows do: documents are keyed "<type>::<id>",
+// where the type is the lower-cased name of T.
+type Repository[T any] struct {
+	store *CouchbaseStore
+}
+
+func NewRepository[T any](store *CouchbaseStore) *Repository[T] {
+	return &Repository[T]{store: store}
+}
+
+// row returns a row holding value under id.
+func (r *Repository[T]) row(id string, value *T) *doc {
+	d := r.store.newDoc(id)
+	d.Data = value
+	return d
+}
+
+// Type returns the type of the documents of the repository.
+func (r *Repository[T]) Type() string {
+	return r.row("", new(T)).GetType()
+}
+
+// Key returns the key of the document with id.
+func (r *Repository[T]) Key(id string) string {
+	return r.row(id, new(T)).GetKey()
+}
+
+func (r *Repository[T]) Get(id string) (T, Meta, error) {
+	var value T
+	row := r.store.ReadOneWithType(r.Key(id), &value)
+	if row.IsFaulted() {
+		var zero T
+		return zero, Meta{}, row.Fault()
+	}
+	return value, metaOf(row), nil
+}
+
+// GetMany reads the documents with ids, reporting whether all of them were read.
+func (r *Repository[T]) GetMany(ids ...string) ([]Item[T], bool) {
+	values := make([]T, len(ids))
+	xs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		xs[i] = r.row(id, &values[i])
+	}
+
+	rows, ok := r.store.Read(xs...)
+	items := make([]Item[T], len(rows))
+	for i, row := range rows {
+		if row.IsFaulted() {
+			items[i].Err = row.Fault()
+			continue
+		}
+		items[i] = Item[T]{Value: values[i], Meta: metaOf(row)}
+	}
+	return items, ok
+}
+
+func (r *Repository[T]) Insert(id string, value T) (Meta, error) {
+	return r.written(r.store.CreateOne(r.row(id, &value)))
+}
+
+// Replace stores value under id. A non-zero cas fails the replacement if the document changed.
+func (r *Repository[T]) Replace(id string, value T, cas gocb.Cas) (Meta, error) {
+	row := r.row(id, &value)
+	row.SetMeta(database.CAS, cas)
+	return r.written(r.store.ReplaceOne(row))
+}
+
+func (r *Repository[T]) Upsert(id string, value T) (Meta, error) {
+	rows, _ := r.store.Upsert(r.row(id, &value))
+	return r.written(rows[0])
+}
+
+// Delete removes the document with id. A non-zero cas fails the removal if the document changed.
+func (r *Repository[T]) Delete(id string, cas gocb.Cas) error {
+	row := r.row(id, new(T))
+	row.SetMeta(database.CAS, cas)
+	return r.store.DestroyOne(row).Fault()
+}
+
+// Mutate lets fn modify the document with id and replaces it, reading and modifying it again
+// when it changed concurrently, see CouchbaseStore.Mutate.
+func (r *Repository[T]) Mutate(id string, fn func(value *T) error) (T, Meta, error) {
+	var value *T
+	row := r.store.mutate(r.Key(id), func() interface{} {
+		value = new(T)
+		return value
+	}, func(database.Row) error {
+		return fn(value)
+	})
+	if row.IsFaulted() {
+		var zero T
+		return zero, Meta{}, row.Fault()
+	}
+	return *value, metaOf(row), nil
+}
+
+// Query decodes the documents selected by q, e.g. with `SELECT b.* FROM b WHERE b._type = $type`.
+func (r *Repository[T]) Query(q database.Query) ([]Item[T], error) {
+	results, err := r.store.Exec(q)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var items []Item[T]
+	for b := results.OneBytes(); b != nil; b = results.OneBytes() {
+		var value T
+		row, err := r.store.DecodeRow(b, &value)
+		if err != nil {
+			items = append(items, Item[T]{Err: err})
+			continue
+		}
+		items = append(items, Item[T]{Value: value, Meta: metaOf(row)})
+	}
+	return items, nil
+}
+
+func (r *Repository[T]) written(row database.Row) (Meta, error) {
+	if row.IsFaulted() {
+		return Meta{}, row.Fault()
+	}
+	return metaOf(row), nil
+}
@@ -0,0 +1,87 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+func TestRepository(t *testing.T) {
+	fake := newFakeBucket()
+	users := NewRepository[User](newStore(fake))
+
+	if users.Type() != "user" || users.Key("1") != "user::1" {
+		t.Errorf("Expected type user and key user::1. got %s and %s.", users.Type(), users.Key("1"))
+	}
+
+	meta, err := users.Insert("1", User{Username: "username"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Key != "user::1" || meta.Cas == 0 || meta.CreatedOn == nil {
+		t.Errorf("Expected the metadata of the document. got %+v.", meta)
+	}
+	if _, err := users.Insert("1", User{}); err == nil {
+		t.Error("Expected inserting an existing document to fail.")
+	}
+
+	u, meta, err := users.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	} else if u.Username != "username" {
+		t.Errorf("Expected username. got %+v.", u)
+	}
+
+	u.Password = "password"
+	if _, err := users.Replace("1", u, meta.Cas); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Replace("1", u, meta.Cas); err == nil {
+		t.Error("Expected replacing with a stale cas to fail.")
+	}
+	if _, err := users.Upsert("2", User{Username: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	items, ok := users.GetMany("1", "2", "3")
+	if ok {
+		t.Error("Expected the missing document to fail the read.")
+	}
+	if items[0].Value.Password != "password" || items[1].Value.Username != "other" {
+		t.Errorf("Expected the documents. got %+v.", items)
+	}
+	if _, missing := items[2].Err.(database.NotFoundError); !missing {
+		t.Errorf("Expected NotFoundError. got %v.", items[2].Err)
+	}
+
+	if err := users.Delete("2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := users.Get("2"); err == nil {
+		t.Error("Expected the deleted document to be missing.")
+	}
+}
+
+func TestRepository_Query(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	users := NewRepository[User](store)
+
+	users.Insert("1", User{Username: "username"})
+	fake.rows = []json.RawMessage{fake.items["user::1"].value, []byte(`[]`)}
+
+	items, err := users.Query(store.NewQuery("SELECT b.* FROM b WHERE b._type = 'user'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 items. got %d.", len(items))
+	}
+	if items[0].Value.Username != "username" || items[0].Meta.Key != "user::1" {
+		t.Errorf("Expected the decoded document. got %+v.", items[0])
+	}
+	if items[1].Err == nil {
+		t.Error("Expected the malformed row to fail.")
+	}
+}
@@ -0,0 +1,269 @@
+package couchbase
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/couchbase/gocb"
+)
+
+// Assert interface implementation
+var _ bucket = (*retryingBucket)(nil)
+
+// RetryPolicy retries operations failing with transient errors: temporary failures, timeouts
+// and locked documents. Operations whose effect is unknown after a timeout, such as inserts,
+// are only retried when the server reports it rejected them.
+type RetryPolicy struct {
+	// MaxAttempts bounds the attempts made for an operation, the first one included.
+	MaxAttempts int
+	// Backoff is the delay before the first retry.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between attempts. The delay isn't capped when zero.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after every retry. Defaults to 2.
+	Multiplier float64
+	// Jitter randomizes every delay by up to this fraction of it.
+	Jitter float64
+	// Overrides replaces the policy for some operations.
+	Overrides map[Operation]*RetryPolicy
+}
+
+// policy returns the policy applied to op.
+func (p *RetryPolicy) policy(op Operation) *RetryPolicy {
+	if o := p.Overrides[op]; o != nil {
+		return o
+	}
+	return p
+}
+
+// delay returns the time to wait before retrying an operation that failed attempt times.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	d := float64(p.Backoff)
+	for i := 1; i < attempt; i++ {
+		d *= multiplier
+		if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// retryable reports whether an operation sent with cas may be attempted again after err.
+func (p *RetryPolicy) retryable(op Operation, cas gocb.Cas, err error) bool {
+	switch err {
+	case gocb.ErrTmpFail:
+		// The server didn't apply the operation: it is overloaded or the document is locked.
+		return true
+	case gocb.ErrTimeout:
+		// The operation may have been applied. Only retry it if applying it twice is harmless.
+		switch op {
+		case OpGet, OpExpiry, OpTouch, OpUpsert, OpReplace:
+			return true
+		case OpRemove:
+			return cas != 0
+		}
+	case gocb.ErrKeyExists:
+		// Without a cas, a replacement only conflicts with a lock.
+		return cas == 0 && (op == OpReplace || op == OpUpsert)
+	}
+	return false
+}
+
+// SetRetryPolicy retries the operations of the store failing with transient errors as described
+// by p. Bulk operations only retry their failed items, or the whole batch when it fails with a
+// transient error. Retries stop once the context of the store is done. Passing nil disables retries.
+func (c *CouchbaseStore) SetRetryPolicy(p *RetryPolicy) {
+	c.retry = p
+	c.compose()
+}
+
+type retryingBucket struct {
+	bucket
+	policy  *RetryPolicy
+	ctx     context.Context
+	onRetry func(op Operation, key string, attempt int, err error)
+}
+
+// wait sleeps for d before the next attempt. It returns false if the context is done first.
+func (b *retryingBucket) wait(d time.Duration) bool {
+	if b.ctx == nil {
+		time.Sleep(d)
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-b.ctx.Done():
+		return false
+	}
+}
+
+func (b *retryingBucket) retried(op Operation, key string, attempt int, err error) {
+	if b.onRetry != nil {
+		b.onRetry(op, key, attempt, err)
+	}
+}
+
+func (b *retryingBucket) do(op Operation, key string, cas gocb.Cas, fn func() error) error {
+	p := b.policy.policy(op)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !p.retryable(op, cas, err) {
+			return err
+		}
+		b.retried(op, key, attempt, err)
+		if !b.wait(p.delay(attempt)) {
+			return err
+		}
+	}
+}
+
+func (b *retryingBucket) Get(key string, valuePtr interface{}) (cas gocb.Cas, err error) {
+	err = b.do(OpGet, key, 0, func() error {
+		cas, err = b.bucket.Get(key, valuePtr)
+		return err
+	})
+	return
+}
+func (b *retryingBucket) GetAndLock(key string, lockTime uint32, valuePtr interface{}) (cas gocb.Cas, err error) {
+	err = b.do(OpGetAndLock, key, 0, func() error {
+		cas, err = b.bucket.GetAndLock(key, lockTime, valuePtr)
+		return err
+	})
+	return
+}
+func (b *retryingBucket) Unlock(key string, cas gocb.Cas) (out gocb.Cas, err error) {
+	err = b.do(OpUnlock, key, cas, func() error {
+		out, err = b.bucket.Unlock(key, cas)
+		return err
+	})
+	return
+}
+func (b *retryingBucket) Touch(key string, cas gocb.Cas, expiry uint32) (out gocb.Cas, err error) {
+	err = b.do(OpTouch, key, cas, func() error {
+		out, err = b.bucket.Touch(key, cas, expiry)
+		return err
+	})
+	return
+}
+func (b *retryingBucket) Insert(key string, value interface{}, expiry uint32) (cas gocb.Cas, err error) {
+	err = b.do(OpInsert, key, 0, func() error {
+		cas, err = b.bucket.Insert(key, value, expiry)
+		return err
+	})
+	return
+}
+func (b *retryingBucket) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (out gocb.Cas, err error) {
+	err = b.do(OpReplace, key, cas, func() error {
+		out, err = b.bucket.Replace(key, value, cas, expiry)
+		return err
+	})
+	return
+}
+func (b *retryingBucket) Remove(key string, cas gocb.Cas) (out gocb.Cas, err error) {
+	err = b.do(OpRemove, key, cas, func() error {
+		out, err = b.bucket.Remove(key, cas)
+		return err
+	})
+	return
+}
+func (b *retryingBucket) Counter(key string, delta, initial int64, expiry uint32) (value uint64, cas gocb.Cas, err error) {
+	err = b.do(OpCounter, key, 0, func() error {
+		value, cas, err = b.bucket.Counter(key, delta, initial, expiry)
+		return err
+	})
+	return
+}
+
+func (b *retryingBucket) Expiry(key string) (expiry uint32, cas gocb.Cas, err error) {
+	err = b.do(OpExpiry, key, 0, func() error {
+		expiry, cas, err = b.bucket.Expiry(key)
+		return err
+	})
+	return
+}
+
+// Do sends the batch and resends the ops failing with a retryable error until they succeed or
+// run out of attempts. The delay between attempts is the largest one among the failed ops.
+func (b *retryingBucket) Do(ops []gocb.BulkOp) error {
+
+	// Remember the cas each op was sent with, results overwrite it.
+	sent := make(map[gocb.BulkOp]gocb.Cas, len(ops))
+	for _, op := range ops {
+		cas, _ := bulkOpResult(op)
+		sent[op] = cas
+	}
+
+	pending := ops
+	for attempt := 1; ; attempt++ {
+		if err := b.bucket.Do(pending); err != nil {
+			// The batch failed as a whole, it is sent again if every op may be retried.
+			delay, ok := b.retryBatch(pending, sent, attempt, err)
+			if !ok || !b.wait(delay) {
+				return err
+			}
+			continue
+		}
+
+		var delay time.Duration
+		failed := make([]gocb.BulkOp, 0, len(pending))
+		for _, op := range pending {
+			name, key := bulkOpKey(op)
+			_, err := bulkOpResult(op)
+			p := b.policy.policy(name)
+			if err == nil || attempt >= p.MaxAttempts || !p.retryable(name, sent[op], err) {
+				continue
+			}
+			b.retried(name, key, attempt, err)
+			if d := p.delay(attempt); d > delay {
+				delay = d
+			}
+			failed = append(failed, op)
+		}
+
+		// Ops left failed when the context is done keep their error.
+		if len(failed) == 0 || !b.wait(delay) {
+			return nil
+		}
+		for _, op := range failed {
+			setBulkOpResult(op, sent[op], nil)
+		}
+		pending = failed
+	}
+}
+
+// retryBatch reports whether the ops of a batch failing with err may be sent again, and the delay
+// to wait before. Their results are reset when they may.
+func (b *retryingBucket) retryBatch(ops []gocb.BulkOp, sent map[gocb.BulkOp]gocb.Cas, attempt int, err error) (time.Duration, bool) {
+	var delay time.Duration
+	for _, op := range ops {
+		name, _ := bulkOpKey(op)
+		p := b.policy.policy(name)
+		if attempt >= p.MaxAttempts || !p.retryable(name, sent[op], err) {
+			return 0, false
+		}
+		if d := p.delay(attempt); d > delay {
+			delay = d
+		}
+	}
+	for _, op := range ops {
+		name, key := bulkOpKey(op)
+		b.retried(name, key, attempt, err)
+		setBulkOpResult(op, sent[op], nil)
+	}
+	return delay, true
+}
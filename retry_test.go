@@ -0,0 +1,132 @@
+package couchbase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+func TestRetryPolicy_Retryable(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3}
+
+	cases := []struct {
+		op       Operation
+		cas      gocb.Cas
+		err      error
+		expected bool
+	}{
+		{OpInsert, 0, gocb.ErrTmpFail, true},
+		{OpInsert, 0, gocb.ErrTimeout, false},
+		{OpInsert, 0, gocb.ErrKeyExists, false},
+		{OpGet, 0, gocb.ErrTimeout, true},
+		{OpGet, 0, gocb.ErrKeyNotFound, false},
+		{OpRemove, 0, gocb.ErrTimeout, false},
+		{OpRemove, 1, gocb.ErrTimeout, true},
+		{OpReplace, 0, gocb.ErrKeyExists, true},
+		{OpReplace, 1, gocb.ErrKeyExists, false},
+	}
+	for _, c := range cases {
+		if p.retryable(c.op, c.cas, c.err) != c.expected {
+			t.Errorf("Expected retryable(%s, %d, %v) to be %t.", c.op, c.cas, c.err, c.expected)
+		}
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := &RetryPolicy{Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+	expected := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond}
+	for i, d := range expected {
+		if got := p.delay(i + 1); got != d {
+			t.Errorf("Expected attempt %d to wait %v. got %v.", i+1, d, got)
+		}
+	}
+}
+
+func TestCouchbaseStore_SetRetryPolicy(t *testing.T) {
+	store := newStore(newFakeBucket())
+	store.InjectFaults(NewFaultInjector(1, Fault{Rate: 0.5, Err: gocb.ErrTmpFail}))
+	store.SetRetryPolicy(&RetryPolicy{MaxAttempts: 50})
+
+	docs := make([]interface{}, 10)
+	for i := range docs {
+		d := newDoc(string(rune('a' + i)))
+		d.SetData(&User{})
+		docs[i] = d
+	}
+
+	// Items inserted by a previous attempt aren't sent again, they would conflict.
+	if rows, ok := store.Create(docs...); !ok {
+		t.Fatal(_firstFault(rows))
+	}
+	if rows, ok := store.Read(docs...); !ok {
+		t.Fatal(_firstFault(rows))
+	}
+	if row := store.ReadOne(docs[0]); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+}
+
+// failingBatches fails the first batches sent with err, without sending them.
+type failingBatches struct {
+	bucket
+	failures int
+	err      error
+}
+
+func (b *failingBatches) Do(ops []gocb.BulkOp) error {
+	if b.failures > 0 {
+		b.failures--
+		return b.err
+	}
+	return b.bucket.Do(ops)
+}
+
+func TestRetryingBucket_Do(t *testing.T) {
+	fake := newFakeBucket()
+	fake.SetTranscoder(transcoder{})
+	failing := &failingBatches{bucket: fake, failures: 2, err: gocb.ErrTimeout}
+	b := &retryingBucket{bucket: failing, policy: &RetryPolicy{MaxAttempts: 3}}
+
+	// Batches failing with a transient error are sent again.
+	ops := []gocb.BulkOp{&gocb.UpsertOp{Key: "a", Value: &User{}}, &gocb.UpsertOp{Key: "b", Value: &User{}}}
+	if err := b.Do(ops); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if _, err := bulkOpResult(op); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Unless an op of the batch can't be applied twice.
+	failing.failures = 1
+	ops = []gocb.BulkOp{&gocb.UpsertOp{Key: "a", Value: &User{}}, &gocb.InsertOp{Key: "c", Value: &User{}}}
+	if err := b.Do(ops); err != gocb.ErrTimeout {
+		t.Errorf("Expected ErrTimeout. got %v.", err)
+	}
+}
+
+func TestRetryingBucket_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	store := newStore(newFakeBucket())
+	store.InjectFaults(NewFaultInjector(1, Fault{Err: gocb.ErrTmpFail}))
+	store.SetRetryPolicy(&RetryPolicy{MaxAttempts: 5, Backoff: time.Hour})
+
+	// Retries stop waiting once the context is done.
+	done := make(chan database.Row)
+	go func() { done <- store.WithContext(ctx).ReadOne("missing") }()
+	select {
+	case row := <-done:
+		if !row.IsFaulted() {
+			t.Error("Expected the read to fail.")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the retries to stop with the context.")
+	}
+}
@@ -0,0 +1,295 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+// Assert interface implementation
+var _ Checkpoint = FileCheckpoint("")
+
+// Transform rewrites the data of a document. Returning false leaves the document untouched.
+type Transform func(data json.RawMessage) (json.RawMessage, bool, error)
+
+// Checkpoint persists the last key migrated by a MigrationJob, so an interrupted job resumes
+// after it.
+type Checkpoint interface {
+	Load() (string, error)
+	Save(key string) error
+}
+
+// FileCheckpoint keeps the checkpoint of a migration in the file at its path.
+type FileCheckpoint string
+
+func (f FileCheckpoint) Load() (string, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+func (f FileCheckpoint) Save(key string) error {
+	tmp := string(f) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(key), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(f))
+}
+
+// MigrationJob rewrites every document of a type. Keys are scanned with N1QL in pages, and
+// the documents of a page are read and written back with their cas in concurrent batches.
+type MigrationJob struct {
+	// Type is the _type of the documents to migrate.
+	Type string
+	// Transform rewrites the data of every document.
+	Transform Transform
+	// PageSize bounds the keys fetched per query. Defaults to 1000.
+	PageSize int
+	// BatchSize bounds the documents per bulk operation. Defaults to 100.
+	BatchSize int
+	// Concurrency bounds the batches in flight. Defaults to 4.
+	Concurrency int
+	// DryRun transforms the documents without writing them back.
+	DryRun bool
+	// Checkpoint resumes the job and is saved after every page, when set.
+	Checkpoint Checkpoint
+	// Progress is called with the report after every page, when set.
+	Progress func(MigrationReport)
+}
+
+// MigrationReport counts the documents seen by a MigrationJob. Documents changed since they were
+// read are conflicted and left untouched: running the job again migrates them.
+type MigrationReport struct {
+	Scanned    int
+	Migrated   int
+	Skipped    int
+	Conflicted int
+	Failed     int
+	LastKey    string
+}
+
+func (r *MigrationReport) add(o MigrationReport) {
+	r.Scanned += o.Scanned
+	r.Migrated += o.Migrated
+	r.Skipped += o.Skipped
+	r.Conflicted += o.Conflicted
+	r.Failed += o.Failed
+}
+
+func (j *MigrationJob) defaults() {
+	if j.PageSize <= 0 {
+		j.PageSize = 1000
+	}
+	if j.BatchSize <= 0 {
+		j.BatchSize = 100
+	}
+	if j.Concurrency <= 0 {
+		j.Concurrency = 4
+	}
+}
+
+// Migrate runs job. It stops at the first page failing to be read or written, without saving
+// the checkpoint of that page, and returns the report of the documents processed so far.
+func (c *CouchbaseStore) Migrate(job MigrationJob) (MigrationReport, error) {
+	job.defaults()
+	report := MigrationReport{}
+
+	after := ""
+	if job.Checkpoint != nil {
+		var err error
+		if after, err = job.Checkpoint.Load(); err != nil {
+			return report, err
+		}
+	}
+
+	for {
+		keys, err := c.scanKeys(job.Type, after, job.PageSize)
+		if err != nil {
+			return report, err
+		}
+		if len(keys) == 0 {
+			return report, nil
+		}
+
+		page, err := c.migratePage(&job, keys)
+		report.add(page)
+		if err != nil {
+			return report, err
+		}
+
+		after = keys[len(keys)-1]
+		report.LastKey = after
+		if job.Checkpoint != nil && !job.DryRun {
+			if err := job.Checkpoint.Save(after); err != nil {
+				return report, err
+			}
+		}
+		if job.Progress != nil {
+			job.Progress(report)
+		}
+		if len(keys) < job.PageSize {
+			return report, nil
+		}
+	}
+}
+
+// scanKeys returns the keys of the documents of typ following after, in key order.
+func (c *CouchbaseStore) scanKeys(typ, after string, limit int) ([]string, error) {
+	statement := fmt.Sprintf("SELECT RAW META(b).id FROM `%s` b WHERE b._type = $type AND META(b).id > $after", c.bucketName)
+	params := map[string]interface{}{"type": typ, "after": after, "limit": limit}
+	if c.tenant != "" {
+		statement += " AND META(b).id LIKE $prefix"
+		params["prefix"] = c.tenantPattern()
+	}
+
+	q := c.NewQuery(statement + " ORDER BY META(b).id LIMIT $limit")
+	q.SetParams(params)
+	q.SetMeta(database.CONSISTENCY, int(gocb.RequestPlus))
+
+	results, err := c.execute(q)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var keys []string
+	for b := results.OneBytes(); b != nil; b = results.OneBytes() {
+		var key string
+		if err := json.Unmarshal(b, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (c *CouchbaseStore) migratePage(job *MigrationJob, keys []string) (MigrationReport, error) {
+	var locker sync.Mutex
+	var wg sync.WaitGroup
+	var failure error
+	report := MigrationReport{}
+	slots := make(chan struct{}, job.Concurrency)
+
+	for start := 0; start < len(keys); start += job.BatchSize {
+		end := start + job.BatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(keys []string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			batch, err := c.migrateBatch(job, keys)
+
+			locker.Lock()
+			defer locker.Unlock()
+			report.add(batch)
+			if err != nil && failure == nil {
+				failure = err
+			}
+		}(keys[start:end])
+	}
+	wg.Wait()
+
+	if failure == nil && report.Failed > 0 {
+		failure = fmt.Errorf("couchbase: failed to migrate %d documents", report.Failed)
+	}
+	return report, failure
+}
+
+func (c *CouchbaseStore) migrateBatch(job *MigrationJob, keys []string) (MigrationReport, error) {
+	report := MigrationReport{Scanned: len(keys)}
+
+	docs := make([]*doc, len(keys))
+	gets := make([]gocb.BulkOp, len(keys))
+	for i, key := range keys {
+		docs[i] = c.newDoc("")
+		docs[i].key = key
+		docs[i].deleted = true
+		gets[i] = &gocb.GetOp{Key: key, Value: docs[i]}
+	}
+	if err := c.bucket.Do(gets); err != nil {
+		return MigrationReport{}, err
+	}
+
+	var sets []gocb.BulkOp
+	for i, op := range gets {
+		get := op.(*gocb.GetOp)
+		if get.Err == gocb.ErrKeyNotFound || get.Err == errStaged {
+			report.Skipped++
+			continue
+		} else if get.Err == errPending {
+			// The document is being written by a transaction.
+			report.Conflicted++
+			continue
+		} else if get.Err != nil {
+			report.Failed++
+			continue
+		}
+
+		data, ok := docs[i].Data.([]byte)
+		if !ok {
+			report.Skipped++
+			continue
+		}
+		data, ok, err := job.Transform(data)
+		if err != nil {
+			return report, fmt.Errorf("couchbase: transforming %q: %v", keys[i], err)
+		} else if !ok {
+			report.Skipped++
+			continue
+		}
+
+		if job.DryRun {
+			report.Migrated++
+			continue
+		}
+
+		// Documents are replaced with their expiry, which reads don't return.
+		expiry, cas, err := c.bucket.Expiry(keys[i])
+		if err == gocb.ErrKeyNotFound || (err == nil && cas != get.Cas) {
+			report.Conflicted++
+			continue
+		} else if err != nil {
+			report.Failed++
+			continue
+		}
+		docs[i].Data = json.RawMessage(data)
+		sets = append(sets, &gocb.ReplaceOp{
+			Key:    keys[i],
+			Value:  docs[i],
+			Cas:    get.Cas,
+			Expiry: expiry,
+		})
+	}
+	if len(sets) == 0 {
+		return report, nil
+	}
+
+	if err := c.bucket.Do(sets); err != nil {
+		return report, err
+	}
+	for _, op := range sets {
+		switch op.(*gocb.ReplaceOp).Err {
+		case nil:
+			report.Migrated++
+		case gocb.ErrKeyExists, gocb.ErrKeyNotFound:
+			report.Conflicted++
+		default:
+			report.Failed++
+		}
+	}
+	return report, nil
+}
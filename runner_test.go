@@ -0,0 +1,159 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// keyScan answers the key scans of Migrate from the documents stored in f.
+func keyScan(f *fakeBucket) func(params interface{}) []json.RawMessage {
+	return func(params interface{}) []json.RawMessage {
+		p := params.(map[string]interface{})
+		f.locker.Lock()
+		defer f.locker.Unlock()
+
+		var keys []string
+		for key, item := range f.items {
+			e := envelope{}
+			if json.Unmarshal(item.value, &e) == nil && e.Type == p["type"] && key > p["after"].(string) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		if limit := p["limit"].(int); len(keys) > limit {
+			keys = keys[:limit]
+		}
+
+		rows := make([]json.RawMessage, len(keys))
+		for i, key := range keys {
+			rows[i], _ = json.Marshal(key)
+		}
+		return rows
+	}
+}
+
+func upperUsername(data json.RawMessage) (json.RawMessage, bool, error) {
+	u := &User{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, false, err
+	}
+	if u.Username == "skip" {
+		return nil, false, nil
+	}
+	u.Username = strings.ToUpper(u.Username)
+	out, err := json.Marshal(u)
+	return out, true, err
+}
+
+func newMigrationStore(t *testing.T, usernames ...string) (*CouchbaseStore, *fakeBucket) {
+	fake := newFakeBucket()
+	fake.query = keyScan(fake)
+	store := newStore(fake)
+
+	for i, username := range usernames {
+		d := store.NewRow(string(rune('1' + i)))
+		d.SetType("user")
+		d.SetData(&User{Username: username})
+		d.SetExpiry(3600)
+		if row := store.CreateOne(d); row.IsFaulted() {
+			t.Fatal(row.Fault())
+		}
+	}
+	order := store.NewRow("1")
+	order.SetType("order")
+	order.SetData(&User{Username: "order"})
+	store.CreateOne(order)
+	return store, fake
+}
+
+func TestCouchbaseStore_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "couchbase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, fake := newMigrationStore(t, "a", "b", "skip", "d", "e")
+
+	var pages int
+	report, err := store.Migrate(MigrationJob{
+		Type:        "user",
+		Transform:   upperUsername,
+		PageSize:    2,
+		BatchSize:   1,
+		Concurrency: 2,
+		Checkpoint:  FileCheckpoint(filepath.Join(dir, "checkpoint")),
+		Progress:    func(MigrationReport) { pages++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := MigrationReport{Scanned: 5, Migrated: 4, Skipped: 1, LastKey: "user::5"}
+	if report != expected || pages != 3 {
+		t.Errorf("Expected %+v over 3 pages. got %+v over %d.", expected, report, pages)
+	}
+
+	u := &User{}
+	store.ReadOneWithType("user::1", u)
+	if u.Username != "A" {
+		t.Errorf("Expected the username to be migrated. got %s.", u.Username)
+	} else if expiry := fake.items["user::1"].expiry; expiry != 3600 {
+		t.Errorf("Expected the document to keep its expiry. got %d.", expiry)
+	}
+	store.ReadOneWithType("order::1", u)
+	if u.Username != "order" {
+		t.Errorf("Expected other types to be left untouched. got %s.", u.Username)
+	}
+
+	// The job resumes from its checkpoint.
+	if key, _ := FileCheckpoint(filepath.Join(dir, "checkpoint")).Load(); key != "user::5" {
+		t.Errorf("Expected checkpoint user::5. got %q.", key)
+	}
+	ckpt := FileCheckpoint(filepath.Join(dir, "resume"))
+	ckpt.Save("user::3")
+	if report, err := store.Migrate(MigrationJob{Type: "user", Transform: upperUsername, Checkpoint: ckpt}); err != nil {
+		t.Fatal(err)
+	} else if report.Scanned != 2 {
+		t.Errorf("Expected 2 documents after the checkpoint. got %+v.", report)
+	}
+}
+
+func TestCouchbaseStore_MigrateDryRun(t *testing.T) {
+	store, fake := newMigrationStore(t, "a", "b")
+	before := string(fake.items["user::1"].value)
+
+	report, err := store.Migrate(MigrationJob{Type: "user", Transform: upperUsername, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 {
+		t.Errorf("Expected 2 documents to be migrated. got %+v.", report)
+	}
+	if after := string(fake.items["user::1"].value); after != before {
+		t.Errorf("Expected dry runs to leave documents untouched. got %s.", after)
+	}
+}
+
+func TestCouchbaseStore_MigrateConflict(t *testing.T) {
+	store, fake := newMigrationStore(t, "a", "b")
+
+	report, err := store.Migrate(MigrationJob{
+		Type: "user",
+		Transform: func(data json.RawMessage) (json.RawMessage, bool, error) {
+			// Another client updates user::1 while it is being migrated.
+			fake.Touch("user::1", 0, 0)
+			return upperUsername(data)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Conflicted != 1 || report.Migrated != 1 {
+		t.Errorf("Expected 1 conflicted and 1 migrated document. got %+v.", report)
+	}
+}
@@ -0,0 +1,168 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+// DELETEDON is the meta key stamped with the time a document was soft-deleted.
+const DELETEDON = "deletedOn"
+
+// errDeleted faults the reads of soft-deleted documents.
+var errDeleted = errors.New("couchbase: document is deleted")
+
+// SoftDelete configures the soft deletion of documents, see SetSoftDelete.
+type SoftDelete struct {
+	// Purge is how long soft-deleted documents are kept before the server removes them.
+	// They are kept until restored when zero.
+	Purge time.Duration
+}
+
+// SetSoftDelete makes Destroy and DestroyOne mark documents deleted with the DELETEDON meta
+// instead of removing them. Soft-deleted documents are read as NotFoundError, unless read with
+// the view returned by WithDeleted, brought back by Restore, and replaced by Create and CreateOne
+// like missing documents. Queries return them: filter them out with `b.meta.deletedOn IS MISSING`.
+// Binary and string documents have no metadata and can't be soft-deleted. Passing nil restores
+// hard deletes.
+func (c *CouchbaseStore) SetSoftDelete(s *SoftDelete) {
+	c.softDelete = s
+}
+
+// WithDeleted returns a view of the store reading soft-deleted documents, with their DELETEDON
+// meta. Like WithContext, the view shares the connection and configuration of c at the time of the call.
+func (c *CouchbaseStore) WithDeleted() *CouchbaseStore {
+	cpy := c.view()
+	cpy.withDeleted = true
+	return cpy
+}
+
+// Restore brings soft-deleted documents back, removing their DELETEDON meta and the expiry set
+// to purge them, or setting the TTL of their row. Documents that aren't deleted are left untouched.
+func (c *CouchbaseStore) Restore(xs ...interface{}) ([]database.Row, bool) {
+	return c.bulk("Restore", xs, c.restore)
+}
+func (c *CouchbaseStore) restore(xs ...interface{}) ([]database.Row, bool) {
+	return c.markAll(xs, false)
+}
+func (c *CouchbaseStore) RestoreOne(x interface{}) database.Row {
+	return c.one("RestoreOne", x, c.restoreOne)
+}
+func (c *CouchbaseStore) restoreOne(x interface{}) database.Row {
+	return c.mark(x, false)
+}
+
+func (c *CouchbaseStore) markAll(xs []interface{}, deleted bool) ([]database.Row, bool) {
+	ok := true
+	rows := make([]database.Row, len(xs))
+	for i, x := range xs {
+		if rows[i] = c.mark(x, deleted); rows[i].IsFaulted() {
+			ok = false
+		}
+	}
+	return rows, ok
+}
+
+// mark soft-deletes or restores the document x, a key or a row. The document is read and
+// replaced with its cas, or with the cas of the row when set. Rows holding data are read into
+// it, so codecs relying on its type, such as EncryptionCodec, encode it back as it was.
+func (c *CouchbaseStore) mark(x interface{}, deleted bool) database.Row {
+
+	doc := c.newDoc("")
+	doc.deleted = true
+	var cas gocb.Cas
+
+	switch value := x.(type) {
+	case string:
+		doc.key = value
+	case database.Row:
+		doc.key = value.GetKey()
+		doc.Id = value.GetId()
+		doc.Type = value.GetType()
+		doc.Data = value.GetData()
+		cas = makeCAS(value.GetMeta(database.CAS))
+	case fmt.Stringer:
+		doc.key = value.String()
+	default:
+		doc.fault = database.InvalidArgsError{errors.New("Unsupported type, expecting string, Stringer or database.Row.")}
+		return doc
+	}
+
+	read, err := c.bucket.Get(doc.GetKey(), doc)
+	if err != nil {
+		doc.fault = makeGetError(err)
+		return doc
+	}
+	if cas != 0 && cas != read {
+		doc.fault = casMismatch()
+		return doc
+	}
+	if contentType := doc.GetMeta(CONTENTTYPE); contentType == ContentTypeBinary || contentType == ContentTypeString {
+		doc.fault = database.InvalidArgsError{fmt.Errorf("couchbase: %s documents can't be soft-deleted", contentType)}
+		return doc
+	}
+
+	_, isDeleted := doc.Meta[DELETEDON]
+	var expiry uint32
+	switch {
+	case deleted && isDeleted:
+		doc.fault = database.NotFoundError{errDeleted}
+		return doc
+	case !deleted && !isDeleted:
+		doc.SetMeta(database.CAS, read)
+		return doc
+	case deleted:
+		doc.SetMeta(DELETEDON, time.Now().UTC())
+		if c.softDelete != nil && c.softDelete.Purge > 0 {
+			expiry = makeExpiry(c.softDelete.Purge)
+		}
+	default:
+		delete(doc.Meta, DELETEDON)
+		if row, ok := x.(database.Row); ok {
+			expiry = makeUint32(row.GetMeta(database.TTL))
+		}
+	}
+
+	// Data read without a target holds the bytes of the document, which are stored as is.
+	value := doc
+	if data, ok := doc.Data.([]byte); ok {
+		cpy := *doc
+		cpy.Data = json.RawMessage(data)
+		value = &cpy
+	}
+	if cas, err := c.bucket.Replace(doc.GetKey(), value, read, expiry); err != nil {
+		doc.fault = makeMutationError(err, read)
+	} else {
+		doc.SetMeta(database.CAS, cas)
+	}
+	return doc
+}
+
+// replaceDeleted replaces the document at key with value when it is soft-deleted, as reads report
+// it missing: creating a document over a deleted one succeeds. err, the error of the insert finding
+// the document, is returned otherwise.
+func (c *CouchbaseStore) replaceDeleted(key string, value interface{}, expiry uint32, err error) (gocb.Cas, error) {
+	stored := &rawValue{}
+	cas, getErr := c.bucket.Get(key, stored)
+	if getErr != nil || !c.deletedValue(stored) {
+		return 0, err
+	}
+	return c.bucket.Replace(key, value, cas, expiry)
+}
+
+// deletedValue reports whether v, as stored, is a soft-deleted document.
+func (c *CouchbaseStore) deletedValue(v *rawValue) bool {
+	if format := v.flags & flagsFormatMask; format == flagsBinary || format == flagsString {
+		return false
+	}
+	e := Envelope{}
+	if c.newDoc("").getCodec().Decode(v.data, &e) != nil {
+		return false
+	}
+	_, deleted := e.Meta[DELETEDON]
+	return deleted
+}
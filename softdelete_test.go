@@ -0,0 +1,148 @@
+package couchbase
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+func TestCouchbaseStore_SoftDelete(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	store.SetSoftDelete(&SoftDelete{Purge: 24 * time.Hour})
+	users := NewRepository[User](store)
+	for _, id := range []string{"1", "2"} {
+		if _, err := users.Insert(id, User{Username: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if row := store.DestroyOne("user::1"); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if _, ok := fake.items["user::1"]; !ok {
+		t.Fatal("Expected the document to be kept.")
+	}
+	if row := store.ReadOne("user::1"); !row.IsFaulted() {
+		t.Error("Expected the deleted document to be read as missing.")
+	} else if _, ok := row.Fault().(database.NotFoundError); !ok {
+		t.Errorf("Expected NotFoundError. got %v.", row.Fault())
+	}
+	if row := store.DestroyOne("user::1"); !row.IsFaulted() {
+		t.Error("Expected deleting a deleted document to fail.")
+	} else if _, ok := row.Fault().(database.NotFoundError); !ok {
+		t.Errorf("Expected NotFoundError. got %v.", row.Fault())
+	}
+
+	var user User
+	d := store.newDoc("")
+	d.key = "user::1"
+	d.Data = &user
+	if row := store.WithDeleted().ReadOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if row.GetMeta(DELETEDON) == nil {
+		t.Error("Expected the document to be stamped with DELETEDON.")
+	} else if user.Username != "1" {
+		t.Errorf("Expected the data to be kept. got %q.", user.Username)
+	}
+
+	// Documents are deleted in bulk, and restored.
+	if _, ok := store.Destroy("user::2"); !ok {
+		t.Fatal("Expected the document to be deleted.")
+	}
+	if rows, ok := store.Restore("user::1", "user::2"); !ok {
+		t.Fatal(rows)
+	}
+	for _, id := range []string{"1", "2"} {
+		if user, meta, err := users.Get(id); err != nil {
+			t.Error(err)
+		} else if user.Username != id || meta.Values[DELETEDON] != nil {
+			t.Errorf("Expected user %s to be restored. got %+v and %v.", id, user, meta)
+		}
+	}
+
+	// Restoring a document that isn't deleted leaves it untouched.
+	cas := fake.items["user::1"].cas
+	if row := store.RestoreOne("user::1"); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if fake.items["user::1"].cas != cas {
+		t.Error("Expected the document to be untouched.")
+	}
+
+	// Creating a deleted document replaces it, one or in bulk.
+	if _, ok := store.Destroy("user::1", "user::2"); !ok {
+		t.Fatal("Expected the documents to be deleted.")
+	}
+	d = store.NewRow("1").(*doc)
+	d.SetType("user")
+	d.SetData(&User{Username: "created"})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	d = store.NewRow("2").(*doc)
+	d.SetType("user")
+	d.SetData(&User{Username: "created"})
+	if rows, ok := store.Create(d); !ok {
+		t.Fatal(rows[0].Fault())
+	}
+	for _, id := range []string{"1", "2"} {
+		if user, meta, err := users.Get(id); err != nil {
+			t.Error(err)
+		} else if user.Username != "created" || meta.Values[DELETEDON] != nil {
+			t.Errorf("Expected user %s to be created. got %+v and %v.", id, user, meta)
+		}
+	}
+	if row := store.CreateOne(d); !row.IsFaulted() {
+		t.Error("Expected creating an existing document to fail.")
+	} else if _, ok := row.Fault().(database.AlreadyExistsError); !ok {
+		t.Errorf("Expected AlreadyExistsError. got %v.", row.Fault())
+	}
+
+	// Without the option, documents are removed.
+	store.SetSoftDelete(nil)
+	if row := store.DestroyOne("user::1"); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if _, ok := fake.items["user::1"]; ok {
+		t.Error("Expected the document to be removed.")
+	}
+
+	// Unsupported elements fault their row without failing the others.
+	if rows, ok := store.Touch("user::2", 42); ok || rows[0].IsFaulted() || !rows[1].IsFaulted() {
+		t.Errorf("Expected only the unsupported element to fault. got %v and %v.", rows[0].Fault(), rows[1].Fault())
+	}
+	if rows, ok := store.Destroy("user::2", 42); ok || rows[0].IsFaulted() || !rows[1].IsFaulted() {
+		t.Errorf("Expected only the unsupported element to fault. got %v and %v.", rows[0].Fault(), rows[1].Fault())
+	}
+	if _, ok := fake.items["user::2"]; ok {
+		t.Error("Expected the document to be removed.")
+	}
+}
+
+func TestCouchbaseStore_SoftDeletePurge(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	users := NewRepository[User](store)
+	for _, id := range []string{"1", "2"} {
+		if _, err := users.Insert(id, User{Username: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.SetSoftDelete(&SoftDelete{Purge: 24 * time.Hour})
+	if row := store.DestroyOne("user::1"); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if expiry := fake.items["user::1"].expiry; expiry != 86400 {
+		t.Errorf("Expected the document to be purged in a day. got %d.", expiry)
+	}
+
+	// Purges longer than 30 days are set as the Unix time they end at.
+	purge := 45 * 24 * time.Hour
+	store.SetSoftDelete(&SoftDelete{Purge: purge})
+	if row := store.DestroyOne("user::2"); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if expiry := int64(fake.items["user::2"].expiry); expiry < time.Now().Add(purge).Unix() {
+		t.Errorf("Expected the document to be purged in 45 days. got %d.", expiry)
+	}
+}
@@ -0,0 +1,189 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+// Assert interface implementation
+var _ KeyStrategy = tenantKeys{}
+
+// TENANT is the meta key stamped with the tenant owning the documents written by a tenant view.
+const TENANT = "tenant"
+
+// errOtherTenant faults the reads of documents owned by another tenant. They are reported as
+// NotFoundError, so tenants can't probe each other's keys.
+var errOtherTenant = errors.New("couchbase: document belongs to another tenant")
+
+// tenantParam matches the references to the $tenant parameter in statements.
+var tenantParam = regexp.MustCompile(`\$tenant\b`)
+
+// tenantKeys prefixes the keys of a strategy with the tenant.
+type tenantKeys struct {
+	KeyStrategy
+	tenant    string
+	separator string
+}
+
+// keySeparator returns the separator joining the parts of the keys built by s. Strategies other
+// than Keys are joined to the tenant with "::".
+func keySeparator(s KeyStrategy) string {
+	if k, ok := s.(Keys); ok {
+		return k.separator()
+	}
+	return "::"
+}
+
+func (k tenantKeys) prefix() string {
+	return k.tenant + k.separator
+}
+
+func (k tenantKeys) Key(typ, id string) string {
+	return k.prefix() + k.KeyStrategy.Key(typ, id)
+}
+
+func (k tenantKeys) Parse(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, k.prefix()) {
+		return "", "", false
+	}
+	return k.KeyStrategy.Parse(key[len(k.prefix()):])
+}
+
+// ForTenant returns a view of the store scoped to tenant. The keys built by its rows are
+// prefixed with the tenant, joined with the separator of the key strategy, the documents it
+// writes are stamped with the TENANT meta, and the documents of other tenants it reads fault
+// with NotFoundError. Queries executed by the view must filter on the $tenant named parameter,
+// which is bound to the tenant, and fail with InvalidArgsError otherwise. The rows they return
+// holding documents of other tenants are dropped. The keys scanned by
+// Migrate are restricted to the tenant. Keys given as strings are used as is.
+// Tenants can't be empty or contain the separator of keys.
+// Like WithContext, the view shares the connection and configuration of c at the time of the call.
+func (c *CouchbaseStore) ForTenant(tenant string) (*CouchbaseStore, error) {
+	sep := keySeparator(c.keyStrategy())
+	if tenant == "" || strings.Contains(tenant, sep) {
+		return nil, database.InvalidArgsError{fmt.Errorf("couchbase: invalid tenant %q", tenant)}
+	}
+
+	cpy := c.view()
+	cpy.tenant = tenant
+	cpy.keys = tenantKeys{KeyStrategy: c.keyStrategy(), tenant: tenant, separator: sep}
+	return cpy, nil
+}
+
+// Tenant returns the tenant the store is scoped to, if any.
+func (c *CouchbaseStore) Tenant() string {
+	return c.tenant
+}
+
+// tenantQuery checks the queries executed by a tenant view filter on the tenant: their statement
+// must reference the $tenant parameter, and their parameters be named.
+func (c *CouchbaseStore) tenantQuery(q database.Query) error {
+	if c.tenant == "" {
+		return nil
+	}
+	if !tenantParam.MatchString(q.GetStatement()) {
+		return database.InvalidArgsError{errors.New("couchbase: queries of a tenant view must filter on $tenant")}
+	}
+	switch q.GetParams().(type) {
+	case nil, map[string]interface{}:
+		return nil
+	}
+	return database.InvalidArgsError{errors.New("couchbase: queries of a tenant view take named parameters")}
+}
+
+// tenantParams binds the $tenant parameter of the queries of a tenant view to its tenant,
+// replacing any value given. Positional parameters are left untouched.
+func (c *CouchbaseStore) tenantParams(params interface{}) interface{} {
+	if c.tenant == "" {
+		return params
+	}
+	switch p := params.(type) {
+	case nil:
+		return map[string]interface{}{TENANT: c.tenant}
+	case map[string]interface{}:
+		cpy := make(map[string]interface{}, len(p)+1)
+		for k, v := range p {
+			cpy[k] = v
+		}
+		cpy[TENANT] = c.tenant
+		return cpy
+	}
+	return params
+}
+
+// tenantRows drops the rows of r holding documents not owned by the tenant of a tenant view,
+// such as returned by statements referencing $tenant without filtering on it. Documents are the
+// rows, or their fields, carrying meta in the layout of EnvelopeCodec.
+func (c *CouchbaseStore) tenantRows(r *queryResult) *queryResult {
+	if c.tenant == "" {
+		return r
+	}
+	data := r.data[:0]
+	for _, row := range r.data {
+		if c.ownsRow(row) {
+			data = append(data, row)
+		}
+	}
+	r.data = data
+	return r
+}
+
+// ownsRow reports whether the documents held by row, whole or under their alias, belong to the
+// tenant. Rows holding no document are owned.
+func (c *CouchbaseStore) ownsRow(row []byte) bool {
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal(row, &fields) != nil {
+		return true
+	}
+	if !c.ownsFields(fields) {
+		return false
+	}
+	for _, value := range fields {
+		doc := map[string]json.RawMessage{}
+		if json.Unmarshal(value, &doc) == nil && !c.ownsFields(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// ownsFields reports whether the document with fields belongs to the tenant, fields without meta
+// not being a document.
+func (c *CouchbaseStore) ownsFields(fields map[string]json.RawMessage) bool {
+	raw, ok := fields["meta"]
+	if !ok {
+		return true
+	}
+	meta := map[string]interface{}{}
+	if json.Unmarshal(raw, &meta) != nil {
+		return true
+	}
+	return meta[TENANT] == c.tenant
+}
+
+// tenantPattern returns the LIKE pattern matching the keys of the tenant.
+func (c *CouchbaseStore) tenantPattern() string {
+	prefix := c.tenant + "::"
+	if k, ok := c.keys.(tenantKeys); ok {
+		prefix = k.prefix()
+	}
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// owned reports whether a document read by a tenant view, with meta, belongs to its tenant.
+// Documents without the TENANT meta, such as binary ones, are owned when their key is.
+func (doc *doc) owned(meta map[string]interface{}) bool {
+	if doc.tenant == "" {
+		return true
+	}
+	if tenant, ok := meta[TENANT]; ok {
+		return tenant == doc.tenant
+	}
+	_, _, ok := doc.keys.Parse(doc.GetKey())
+	return ok
+}
@@ -0,0 +1,153 @@
+package couchbase
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+func TestCouchbaseStore_ForTenant(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	acme, _ := store.ForTenant("acme")
+	globex, _ := store.ForTenant("globex")
+
+	d := acme.NewRow("1")
+	d.SetType("user")
+	d.SetMeta(TENANT, "globex")
+	d.SetData(&User{Username: "username"})
+	if row := acme.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if row.GetKey() != "acme::user::1" {
+		t.Errorf("Expected key acme::user::1. got %s.", row.GetKey())
+	}
+
+	e := envelope{}
+	if err := json.Unmarshal(fake.items["acme::user::1"].value, &e); err != nil {
+		t.Fatal(err)
+	} else if e.Meta[TENANT] != "acme" {
+		t.Errorf("Expected the document to be stamped with its tenant. got %v.", e.Meta)
+	}
+
+	if row := acme.ReadOne("acme::user::1"); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if row := globex.ReadOne("acme::user::1"); !row.IsFaulted() {
+		t.Error("Expected reads of another tenant to fault.")
+	} else if _, ok := row.Fault().(database.NotFoundError); !ok {
+		t.Errorf("Expected NotFoundError. got %v.", row.Fault())
+	}
+	if rows, ok := globex.Read("acme::user::1"); ok {
+		t.Errorf("Expected bulk reads of another tenant to fault. got %v.", rows[0].GetData())
+	}
+
+	if typ, id, ok := acme.ParseKey("acme::user::1"); !ok || typ != "user" || id != "1" {
+		t.Errorf("Expected user and 1. got %s and %s.", typ, id)
+	}
+	if _, _, ok := globex.ParseKey("acme::user::1"); ok {
+		t.Error("Expected keys of another tenant not to parse.")
+	}
+	if acme.Tenant() != "acme" || store.Tenant() != "" {
+		t.Error("Expected the view to be scoped without scoping the store.")
+	}
+}
+
+func TestCouchbaseStore_ForTenantQuery(t *testing.T) {
+	fake := newFakeBucket()
+	var params interface{}
+	fake.query = func(p interface{}) []json.RawMessage {
+		params = p
+		return nil
+	}
+	acme, err := newStore(fake).ForTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := acme.NewQuery("SELECT b.* FROM b WHERE b.meta.tenant = $tenant AND b._type = $type")
+	q.SetParams(map[string]interface{}{"type": "user", TENANT: "globex"})
+	if _, err := acme.Exec(q); err != nil {
+		t.Fatal(err)
+	}
+	if p := params.(map[string]interface{}); p[TENANT] != "acme" || p["type"] != "user" {
+		t.Errorf("Expected the tenant to be bound. got %v.", p)
+	}
+	if q.GetParams().(map[string]interface{})[TENANT] != "globex" {
+		t.Error("Expected the query parameters to be left untouched.")
+	}
+
+	// Documents of other tenants are dropped from statements not filtering on $tenant.
+	rows := []json.RawMessage{
+		json.RawMessage(`{"$1":"acme","_uId":"1","_type":"user","data":{},"meta":{"tenant":"acme"}}`),
+		json.RawMessage(`{"$1":"acme","_uId":"2","_type":"user","data":{},"meta":{"tenant":"globex"}}`),
+		json.RawMessage(`{"$1":"acme","b":{"_uId":"3","_type":"user","data":{},"meta":{}}}`),
+		json.RawMessage(`{"n":3}`),
+	}
+	fake.query = func(p interface{}) []json.RawMessage {
+		params = p
+		return rows
+	}
+	results, err := acme.Exec(acme.NewQuery("SELECT $tenant, b.* FROM b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	results.ForEach(func(_ int, b []byte) {
+		var row struct {
+			Id string `json:"_uId"`
+		}
+		json.Unmarshal(b, &row)
+		ids = append(ids, row.Id)
+	})
+	if len(ids) != 2 || ids[0] != "1" || ids[1] != "" {
+		t.Errorf("Expected the documents of acme and other rows. got %q.", ids)
+	}
+	rows = nil
+
+	// Queries not filtering on the tenant are rejected.
+	for statement, params := range map[string]interface{}{
+		"SELECT b.* FROM b WHERE b._type = $type":                          nil,
+		"SELECT b.* FROM b WHERE b.meta.tenant = $tenantId":                nil,
+		"SELECT b.* FROM b WHERE b.meta.tenant = $tenant AND b._type = $1": []interface{}{"user"},
+	} {
+		q := acme.NewQuery(statement)
+		q.SetParams(params)
+		if _, err := acme.Exec(q); err == nil {
+			t.Errorf("Expected %q to be rejected.", q.GetStatement())
+		} else if _, ok := err.(database.InvalidArgsError); !ok {
+			t.Errorf("Expected InvalidArgsError. got %v.", err)
+		}
+	}
+
+	if _, err := acme.Migrate(MigrationJob{Type: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := params.(map[string]interface{}); p["prefix"] != `acme::%` {
+		t.Errorf("Expected the key scan to be restricted to the tenant. got %v.", p)
+	}
+}
+
+func TestCouchbaseStore_ForTenantKeys(t *testing.T) {
+	store := newStore(newFakeBucket())
+	store.SetKeyStrategy(Keys{Separator: "/"})
+
+	acme, err := store.ForTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := acme.NewRow("1")
+	d.SetType("user")
+	if key := d.GetKey(); key != "acme/user/1" {
+		t.Errorf("Expected key acme/user/1. got %s.", key)
+	}
+	if p := acme.tenantPattern(); p != "acme/%" {
+		t.Errorf("Expected pattern acme/%%. got %s.", p)
+	}
+
+	for _, tenant := range []string{"", "ac/me"} {
+		if _, err := store.ForTenant(tenant); err == nil {
+			t.Errorf("Expected tenant %q to be rejected.", tenant)
+		}
+	}
+}
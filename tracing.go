@@ -0,0 +1,91 @@
+package couchbase
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/Tlantic/go-couchbase-adapter"
+
+// Tracing returns a middleware emitting a span for every call made to a store, as a child of
+// the span carried by the store's context. Spans describe the operation, the bucket, the keys
+// and types of the documents involved and the class of the errors met.
+func Tracing(tp trace.TracerProvider) Middleware {
+	tracer := tp.Tracer(tracerName)
+
+	return func(next Handler) Handler {
+		return func(call *Call) error {
+			ctx, span := tracer.Start(call.Context, "couchbase."+call.Method,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("db.system", "couchbase"),
+					attribute.String("db.name", call.Bucket),
+					attribute.String("db.operation", call.Method),
+				))
+			defer span.End()
+
+			call.Context = ctx
+			if call.Query != nil {
+				span.SetAttributes(attribute.String("db.statement", call.Query.GetStatement()))
+			} else {
+				span.SetAttributes(attribute.Int("couchbase.bulk_size", len(call.Args)))
+			}
+
+			err := next(call)
+			traceRows(span, call)
+
+			if err != nil {
+				span.SetAttributes(attribute.String("couchbase.error", errorClass(err)))
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return err
+		}
+	}
+}
+
+func traceRows(span trace.Span, call *Call) {
+	if len(call.Rows) == 0 {
+		return
+	}
+
+	keys := make([]string, len(call.Rows))
+	types := make([]string, 0, 1)
+	seen := map[string]bool{}
+	faults, conflicts := 0, 0
+	var fault error
+
+	for i, row := range call.Rows {
+		keys[i] = row.GetKey()
+		if t := row.GetType(); t != "" && !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+		if row.IsFaulted() {
+			if faults++; fault == nil {
+				fault = row.Fault()
+			}
+			if isCASConflict(row.Fault()) {
+				conflicts++
+			}
+		}
+	}
+
+	if len(keys) == 1 {
+		span.SetAttributes(attribute.String("couchbase.document.key", keys[0]))
+	} else {
+		span.SetAttributes(attribute.StringSlice("couchbase.document.keys", keys))
+	}
+	span.SetAttributes(
+		attribute.StringSlice("couchbase.document.types", types),
+		attribute.Int("couchbase.cas_conflicts", conflicts),
+		attribute.Int("couchbase.faults", faults),
+	)
+
+	if fault != nil {
+		span.SetAttributes(attribute.String("couchbase.error", errorClass(fault)))
+		span.RecordError(fault)
+		span.SetStatus(codes.Error, fault.Error())
+	}
+}
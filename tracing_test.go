@@ -0,0 +1,103 @@
+package couchbase
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	store := newStore(newFakeBucket())
+	store.bucketName = "test"
+	store.Use(Tracing(tp))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	traced := store.WithContext(ctx)
+
+	d1 := newDoc("1")
+	d1.SetData(&User{})
+	d2 := newDoc("2")
+	d2.SetData(&User{})
+	traced.Create(d1, d2)
+	traced.ReadOne("missing")
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans. got %d.", len(spans))
+	}
+
+	create, read := spans[0], spans[1]
+	if create.Name() != "couchbase.Create" {
+		t.Errorf("Expected span couchbase.Create. got %s.", create.Name())
+	}
+	if create.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("Expected spans to be children of the context's span.")
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range create.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["db.name"].AsString() != "test" {
+		t.Errorf("Expected db.name test. got %s.", attrs["db.name"].AsString())
+	}
+	if attrs["couchbase.bulk_size"].AsInt64() != 2 {
+		t.Errorf("Expected bulk size 2. got %d.", attrs["couchbase.bulk_size"].AsInt64())
+	}
+	if types := attrs["couchbase.document.types"].AsStringSlice(); len(types) != 1 || types[0] != "user" {
+		t.Errorf("Expected types [user]. got %v.", types)
+	}
+
+	if read.Status().Code != codes.Error {
+		t.Error("Expected ReadOne span to report an error.")
+	}
+	for _, kv := range read.Attributes() {
+		if kv.Key == "couchbase.error" && kv.Value.AsString() != "NotFoundError" {
+			t.Errorf("Expected error class NotFoundError. got %s.", kv.Value.AsString())
+		}
+	}
+}
+
+// countingCloses counts the calls to Close.
+type countingCloses struct {
+	bucket
+	closes int
+}
+
+func (b *countingCloses) Close() error {
+	b.closes++
+	return b.bucket.Close()
+}
+
+func TestCouchbaseStore_WithContext_Close(t *testing.T) {
+	mu.Lock()
+	before := openStores
+	mu.Unlock()
+
+	conn := &countingCloses{bucket: newFakeBucket()}
+	store := newStore(conn)
+	acme, _ := store.ForTenant("acme")
+	for _, view := range []*CouchbaseStore{store.WithContext(context.Background()), acme, store.WithDeleted()} {
+		view.Close()
+	}
+	if conn.closes != 0 {
+		t.Error("Expected closing a view to leave the connection open.")
+	}
+
+	store.Close()
+	store.Close()
+	mu.Lock()
+	after := openStores
+	mu.Unlock()
+	if conn.closes != 1 || after != before {
+		t.Errorf("Expected the connection to be closed once. got %d closes and %d open stores.", conn.closes, after-before)
+	}
+}
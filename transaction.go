@@ -0,0 +1,726 @@
+package couchbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+// TXN is the meta key stamped with the transaction that last wrote a document.
+const TXN = "txn"
+
+// txnInsert marks the markers reserving the keys inserted by a transaction, which are read as
+// missing documents.
+const txnInsert = "txnInsert"
+
+// flagsTxn are the flags of the markers standing for the documents written by a transaction until
+// it is applied or rolled back. They use the private format of the common flags, so markers are
+// told apart whatever the codec of the store.
+const flagsTxn uint32 = 1 << 24
+
+// ErrTransactionIncomplete is returned by Transaction when it committed, or may have, but failed
+// to write some of its documents. RecoverTransactions completes it, unless the documents were
+// overwritten by writes without a cas, which replace the writes of the transaction.
+var ErrTransactionIncomplete = errors.New("couchbase: transaction committed but not fully applied")
+
+// errOverwritten faults the writes of a transaction whose marker was overwritten by a write
+// without a cas.
+var errOverwritten = errors.New("couchbase: transaction marker was overwritten")
+
+// errStaged faults the reads of the marker of a document being inserted.
+var errStaged = errors.New("couchbase: document is being inserted by a transaction")
+
+// errPending faults the reads of the marker of a document being written.
+var errPending = errors.New("couchbase: document is being written by a transaction")
+
+// txRecordType is the type of transaction records.
+const txRecordType = "_txn"
+
+type txState string
+
+const (
+	txPending   txState = "pending"
+	txCommitted txState = "committed"
+	txAborted   txState = "aborted"
+)
+
+type txOp string
+
+const (
+	txInsert  txOp = "insert"
+	txReplace txOp = "replace"
+	txRemove  txOp = "remove"
+)
+
+// Tx stages the writes of a transaction, see CouchbaseStore.Transaction. It isn't safe for
+// concurrent use.
+type Tx struct {
+	store  *CouchbaseStore
+	id     string
+	reads  map[string]*txRead
+	writes map[string]*txWrite
+}
+
+// txRead is a document read by a transaction, nil when it was missing.
+type txRead struct {
+	cas   gocb.Cas
+	value *rawValue
+	// deleted is set for soft-deleted documents, which the transaction sees as missing.
+	deleted bool
+}
+
+// txWrite is a write staged by a transaction. Removals of a store soft-deleting documents hold
+// the document marked deleted, which replaces it.
+type txWrite struct {
+	key    string
+	op     txOp
+	value  *rawValue
+	expiry uint32
+}
+
+// txRecord is the log of a transaction, saved before its documents are replaced with markers.
+// Pending transactions are rolled back with it, committed ones applied.
+type txRecord struct {
+	Started time.Time       `json:"started"`
+	State   txState         `json:"state"`
+	Writes  []txRecordWrite `json:"writes"`
+}
+
+type txRecordWrite struct {
+	Key    string `json:"key"`
+	Op     txOp   `json:"op"`
+	Value  []byte `json:"value,omitempty"`
+	Flags  uint32 `json:"flags,omitempty"`
+	Expiry uint32 `json:"expiry,omitempty"`
+	// Prev is the document replaced or removed, restored on rollback with its flags and expiry.
+	Prev       []byte `json:"prev,omitempty"`
+	PrevFlags  uint32 `json:"prevFlags,omitempty"`
+	PrevExpiry uint32 `json:"prevExpiry,omitempty"`
+
+	// cas is the cas of the marker of the document, when known.
+	cas gocb.Cas
+}
+
+// Transaction runs fn and commits the writes it staged on tx all at once, or none of them.
+// Writes are only sent on commit, after fn returns: an error returned by fn discards them.
+//
+// Committing saves the writes in a pending transaction record, then replaces the documents
+// written, in key order, with markers, with the cas they were read with. The documents read by
+// fn are checked unchanged and the record is marked committed, the commit point, before the
+// writes are applied over the markers. Markers are read as LockedError, caused by
+// DocumentLockedError, and those of inserted documents as NotFoundError. Writers holding a cas
+// read before the commit fail with a LockedError caused by CASMismatchError, and others can't
+// read one until the transaction is applied or rolled back.
+// Readers see every document as it was before or after the transaction, but may see some
+// documents of a transaction being applied before others. Writes without a cas aren't isolated.
+//
+// Transactions conflicting with concurrent writes run again, fn included, like Mutate.
+// A transaction failing once committed returns ErrTransactionIncomplete: its record and markers
+// remain until RecoverTransactions completes it. So does a transaction whose markers were
+// overwritten by writes without a cas, whose writes are then lost.
+func (c *CouchbaseStore) Transaction(fn func(tx *Tx) error) error {
+	attempts := c.mutateAttempts
+	if attempts <= 0 {
+		attempts = DefaultMutateAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		tx := &Tx{
+			store:  c,
+			id:     c.keyStrategy().NewId(),
+			reads:  map[string]*txRead{},
+			writes: map[string]*txWrite{},
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		err := tx.commit()
+		if !isTxConflict(err) || attempt >= attempts || c.context().Err() != nil {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
+}
+
+// isTxConflict reports whether a transaction failed because of a concurrent write.
+func isTxConflict(err error) bool {
+	switch Cause(err).(type) {
+	case CASMismatchError, DocumentLockedError:
+		return true
+	}
+	return false
+}
+
+// Id returns the id of the transaction, stamped on the documents it writes as the TXN meta.
+func (tx *Tx) Id() string {
+	return tx.id
+}
+
+// Get reads the document at key into out, like ReadOneWithType. Documents written by the
+// transaction are read as staged.
+func (tx *Tx) Get(key string, out interface{}) database.Row {
+	d := tx.store.newDoc("")
+	d.key = key
+	d.Data = out
+
+	if w := tx.writes[key]; w != nil {
+		if w.op == txRemove {
+			d.fault = database.NotFoundError{gocb.ErrKeyNotFound}
+		} else if err := d.decode(w.value.data, w.value.flags); err != nil {
+			d.fault = makeReadError(err)
+		}
+		return d
+	}
+
+	read, err := tx.read(key)
+	if err == nil && read == nil {
+		err = gocb.ErrKeyNotFound
+	}
+	if err == nil {
+		err = d.decode(read.value.data, read.value.flags)
+	}
+	if err != nil {
+		d.fault = makeGetError(err)
+		return d
+	}
+	d.SetMeta(database.CAS, read.cas)
+	return d
+}
+
+// read returns the document at key as read by the transaction, reading it the first time.
+func (tx *Tx) read(key string) (*txRead, error) {
+	if read, ok := tx.reads[key]; ok {
+		return read, nil
+	}
+
+	value := &rawValue{}
+	cas, err := tx.store.bucket.Get(key, value)
+	if err == nil && value.flags == flagsTxn {
+		return nil, markerError(value.data)
+	}
+	switch err {
+	case nil:
+		tx.reads[key] = &txRead{cas: cas, value: value, deleted: tx.store.deletedValue(value)}
+	case gocb.ErrKeyNotFound:
+		tx.reads[key] = nil
+	default:
+		return nil, err
+	}
+	return tx.reads[key], nil
+}
+
+// Insert stages the insertion of row. It fails with AlreadyExistsError if the transaction saw
+// the document. Soft-deleted documents are replaced.
+func (tx *Tx) Insert(row database.Row) error {
+	w, err := tx.stage(row, txInsert)
+	if err != nil {
+		return err
+	}
+	if prev := tx.writes[w.key]; prev != nil && prev.op != txRemove {
+		return database.AlreadyExistsError{gocb.ErrKeyExists}
+	} else if prev == nil {
+		if read, err := tx.read(w.key); err != nil {
+			return makeGetError(err)
+		} else if read != nil && !read.deleted {
+			return database.AlreadyExistsError{gocb.ErrKeyExists}
+		} else if read != nil {
+			w.op = txReplace
+		}
+	} else {
+		// Inserting a removed document replaces it.
+		w.op = txReplace
+	}
+	tx.writes[w.key] = w
+	return nil
+}
+
+// Replace stages the replacement of row. A row holding a cas fails with a LockedError caused by
+// CASMismatchError if the document has another one.
+func (tx *Tx) Replace(row database.Row) error {
+	w, err := tx.stage(row, txReplace)
+	if err != nil {
+		return err
+	}
+	if err := tx.expect(w.key, makeCAS(row.GetMeta(database.CAS))); err != nil {
+		return err
+	}
+	if prev := tx.writes[w.key]; prev != nil && prev.op == txInsert {
+		w.op = txInsert
+	}
+	tx.writes[w.key] = w
+	return nil
+}
+
+// Remove stages the removal of the document x, a key or a row, like DestroyOne: the document is
+// soft-deleted when the store is set to, see SetSoftDelete.
+func (tx *Tx) Remove(x interface{}) error {
+	var key string
+	var cas gocb.Cas
+	switch value := x.(type) {
+	case string:
+		key = value
+	case database.Row:
+		key = value.GetKey()
+		cas = makeCAS(value.GetMeta(database.CAS))
+	case fmt.Stringer:
+		key = value.String()
+	default:
+		return database.InvalidArgsError{errors.New("Unsupported type, expecting string, Stringer or Row.")}
+	}
+
+	if err := tx.expect(key, cas); err != nil {
+		return err
+	}
+	prev := tx.writes[key]
+	if prev != nil && prev.op == txInsert {
+		delete(tx.writes, key)
+		return nil
+	}
+	if tx.store.softDelete == nil {
+		tx.writes[key] = &txWrite{key: key, op: txRemove}
+		return nil
+	}
+
+	// The document is marked as last staged, or as read.
+	value := tx.reads[key].value
+	if prev != nil {
+		value = prev.value
+	}
+	w, err := tx.markDeleted(key, value)
+	if err != nil {
+		return err
+	}
+	tx.writes[key] = w
+	return nil
+}
+
+// markDeleted stages the soft deletion of the document at key, holding value.
+func (tx *Tx) markDeleted(key string, value *rawValue) (*txWrite, error) {
+	c := tx.store
+	d := c.newDoc("")
+	d.key = key
+	d.deleted = true
+	if err := d.decode(value.data, value.flags); err != nil {
+		return nil, makeReadError(err)
+	}
+	if contentType := d.GetMeta(CONTENTTYPE); contentType == ContentTypeBinary || contentType == ContentTypeString {
+		return nil, database.InvalidArgsError{fmt.Errorf("couchbase: %s documents can't be soft-deleted", contentType)}
+	}
+	if data, ok := d.Data.([]byte); ok {
+		d.Data = json.RawMessage(data)
+	}
+	d.SetMeta(DELETEDON, time.Now().UTC())
+	d.SetMeta(TXN, tx.id)
+
+	data, flags, err := d.encode()
+	if err != nil {
+		return nil, database.InvalidArgsError{err}
+	}
+	w := &txWrite{key: key, op: txRemove, value: &rawValue{data, flags}}
+	if c.softDelete.Purge > 0 {
+		w.expiry = makeExpiry(c.softDelete.Purge)
+	}
+	return w, nil
+}
+
+// expect checks the document at key exists, with cas when not zero. Soft-deleted documents don't.
+func (tx *Tx) expect(key string, cas gocb.Cas) error {
+	if w := tx.writes[key]; w != nil {
+		if w.op == txRemove {
+			return database.NotFoundError{gocb.ErrKeyNotFound}
+		}
+		return nil
+	}
+
+	read, err := tx.read(key)
+	if err != nil {
+		return makeGetError(err)
+	} else if read == nil || read.deleted {
+		return database.NotFoundError{gocb.ErrKeyNotFound}
+	} else if cas != 0 && cas != read.cas {
+		return casMismatch()
+	}
+	return nil
+}
+
+// stage encodes the document written by row.
+func (tx *Tx) stage(row database.Row, op txOp) (*txWrite, error) {
+	if row == nil {
+		return nil, database.InvalidArgsError{errors.New("Unsupported type, expecting Row.")}
+	}
+
+	d := tx.store.newDoc("")
+	now := time.Now().UTC()
+	d.SetMeta(database.CREATEDON, now)
+	d.key = row.GetKey()
+	d.Id = row.GetId()
+	d.Type = row.GetType()
+	d.Data = row.GetData()
+	d.mergeMetadata(row.Metadata())
+	d.SetMeta(database.UPDATEDON, now)
+	delete(d.Meta, database.CAS)
+	delete(d.Meta, database.LOCK)
+	d.SetMeta(TXN, tx.id)
+
+	if err := tx.store.validate(d); err != nil {
+		return nil, err
+	}
+	data, flags, err := d.encode()
+	if err != nil {
+		return nil, database.InvalidArgsError{err}
+	}
+	expiry := makeUint32(d.GetMeta(database.TTL))
+	return &txWrite{key: d.GetKey(), op: op, value: &rawValue{data, flags}, expiry: expiry}, nil
+}
+
+// commit saves the record of the transaction, replaces the documents written with markers,
+// checks the documents read are unchanged, commits the record and applies it.
+func (tx *Tx) commit() error {
+	c := tx.store
+
+	keys := make([]string, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		return tx.check()
+	}
+
+	record := txRecord{Started: time.Now().UTC(), State: txPending}
+	for _, key := range keys {
+		w := tx.writes[key]
+		rw := txRecordWrite{Key: w.key, Op: w.op, Expiry: w.expiry}
+		if w.value != nil {
+			rw.Value, rw.Flags = w.value.data, w.value.flags
+		}
+		if w.op != txInsert {
+			// Documents are restored with their expiry, which reads don't return.
+			read := tx.reads[key]
+			expiry, cas, err := c.bucket.Expiry(key)
+			if err != nil {
+				return makeGetError(err)
+			} else if cas != read.cas {
+				return casMismatch()
+			}
+			rw.Prev, rw.PrevFlags, rw.PrevExpiry = read.value.data, read.value.flags, expiry
+		}
+		record.Writes = append(record.Writes, rw)
+	}
+
+	recordDoc := c.txRecordDoc(tx.id, &record)
+	recordCas, err := c.bucket.Insert(recordDoc.GetKey(), recordDoc, 0)
+	if err != nil {
+		return makeCreateError(err)
+	}
+	rollback := func() {
+		c.rollbackTransaction(recordDoc.GetKey(), tx.id, record)
+	}
+
+	for i := range record.Writes {
+		if err := tx.mark(&record.Writes[i]); err != nil {
+			rollback()
+			return err
+		}
+	}
+	if err := tx.check(); err != nil {
+		rollback()
+		return err
+	}
+
+	record.State = txCommitted
+	switch _, err := c.bucket.Replace(recordDoc.GetKey(), recordDoc, recordCas, 0); err {
+	case nil:
+	case gocb.ErrKeyExists, gocb.ErrKeyNotFound:
+		// RecoverTransactions took the transaction for abandoned and rolls it back.
+		return database.LockedError{CASMismatchError{err}}
+	default:
+		// The transaction may have committed: RecoverTransactions applies or rolls it back.
+		return fmt.Errorf("%w: %v", ErrTransactionIncomplete, makeMutationError(err, recordCas))
+	}
+
+	// Committed: the writes are applied, now or by RecoverTransactions.
+	return c.applyTransaction(recordDoc.GetKey(), tx.id, record)
+}
+
+// check checks the documents read by the transaction, and not written, are unchanged.
+func (tx *Tx) check() error {
+	for key, read := range tx.reads {
+		if tx.writes[key] != nil {
+			continue
+		}
+		cas, err := tx.store.bucket.Get(key, &rawValue{})
+		if err == gocb.ErrKeyNotFound && read == nil {
+			continue
+		}
+		if err != nil && err != gocb.ErrKeyNotFound {
+			return makeGetError(err)
+		}
+		if read == nil || err != nil || cas != read.cas {
+			return casMismatch()
+		}
+	}
+	return nil
+}
+
+// mark replaces the document of w with a marker of the transaction, with the cas it was read
+// with. Inserted keys are reserved with a marker.
+func (tx *Tx) mark(w *txRecordWrite) error {
+	c := tx.store
+	marker := txMarker(tx.id, w.Op)
+
+	var err error
+	if w.Op == txInsert {
+		if w.cas, err = c.bucket.Insert(w.Key, marker, 0); err != nil {
+			return makeCreateError(err)
+		}
+		return nil
+	}
+	read := tx.reads[w.Key]
+	if w.cas, err = c.bucket.Replace(w.Key, marker, read.cas, 0); err != nil {
+		return makeMutationError(err, read.cas)
+	}
+	return nil
+}
+
+// txRecordDoc returns the record of the transaction id. Records are stored with EnvelopeCodec,
+// whatever the codec of the store, so RecoverTransactions finds them by type.
+func (c *CouchbaseStore) txRecordDoc(id string, record *txRecord) *doc {
+	d := c.newDoc(id)
+	d.Type = txRecordType
+	d.Data = record
+	d.codec = EnvelopeCodec{}
+	d.migrations = nil
+	d.deleted = false
+	return d
+}
+
+// txMarker returns the marker standing for a document written by the transaction id.
+func txMarker(id string, op txOp) *rawValue {
+	meta := map[string]interface{}{TXN: id}
+	if op == txInsert {
+		meta[txnInsert] = true
+	}
+	data, _ := EnvelopeCodec{}.Encode(&Envelope{Meta: meta})
+	return &rawValue{data, flagsTxn}
+}
+
+// markerError returns the error the reads of the marker data fault with.
+func markerError(data []byte) error {
+	e := Envelope{}
+	if (EnvelopeCodec{}).Decode(data, &e) == nil && staged(e.Meta) {
+		return errStaged
+	}
+	return errPending
+}
+
+// markerCas returns the cas of the document at key when it is a marker of the transaction id.
+func (c *CouchbaseStore) markerCas(id, key string) (gocb.Cas, bool, error) {
+	value := &rawValue{}
+	cas, err := c.bucket.Get(key, value)
+	if err == gocb.ErrKeyNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	e := Envelope{}
+	if value.flags != flagsTxn || (EnvelopeCodec{}).Decode(value.data, &e) != nil || e.Meta[TXN] != id {
+		return 0, false, nil
+	}
+	return cas, true, nil
+}
+
+// applyTransaction applies the writes of the committed transaction id and removes its record.
+// The record is removed when the only writes failing are overwritten, as nothing is left to apply.
+func (c *CouchbaseStore) applyTransaction(recordKey, id string, record txRecord) error {
+	var failed, lost error
+	for _, w := range record.Writes {
+		switch err := c.applyTxWrite(id, w); {
+		case err == errOverwritten:
+			lost = err
+		case err != nil && failed == nil:
+			failed = err
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("%w: %v", ErrTransactionIncomplete, failed)
+	}
+	c.bucket.Remove(recordKey, 0)
+	if lost != nil {
+		return fmt.Errorf("%w: %v", ErrTransactionIncomplete, lost)
+	}
+	return nil
+}
+
+// applyTxWrite applies a write of the transaction id over its marker. Writes already applied,
+// whose document isn't a marker anymore, are skipped. Removals holding a value soft-delete the
+// document, replacing it with the value.
+func (c *CouchbaseStore) applyTxWrite(id string, w txRecordWrite) error {
+	var applied *rawValue
+	if w.Op != txRemove || w.Value != nil {
+		applied = &rawValue{w.Value, w.Flags}
+	}
+	return c.replaceMarker(id, w, applied, func(cas gocb.Cas) (err error) {
+		if applied == nil {
+			_, err = c.bucket.Remove(w.Key, cas)
+		} else {
+			_, err = c.bucket.Replace(w.Key, &rawValue{w.Value, w.Flags}, cas, w.Expiry)
+		}
+		return
+	})
+}
+
+// rollbackTransaction restores the documents of the transaction id and removes its record.
+func (c *CouchbaseStore) rollbackTransaction(recordKey, id string, record txRecord) error {
+	var failed error
+	for _, w := range record.Writes {
+		// Documents overwritten without a cas keep the value written.
+		if err := c.rollbackTxWrite(id, w); err != nil && err != errOverwritten && failed == nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	c.bucket.Remove(recordKey, 0)
+	return nil
+}
+
+// rollbackTxWrite restores the document replaced by the marker of a write of the transaction id.
+func (c *CouchbaseStore) rollbackTxWrite(id string, w txRecordWrite) error {
+	var restored *rawValue
+	if w.Op != txInsert {
+		restored = &rawValue{w.Prev, w.PrevFlags}
+	}
+	return c.replaceMarker(id, w, restored, func(cas gocb.Cas) (err error) {
+		if restored == nil {
+			_, err = c.bucket.Remove(w.Key, cas)
+		} else {
+			_, err = c.bucket.Replace(w.Key, &rawValue{w.Prev, w.PrevFlags}, cas, w.PrevExpiry)
+		}
+		return
+	})
+}
+
+// replaceMarker calls replace with the cas of the marker of w, replacing it with want, or removing
+// it when nil, unless its document isn't a marker of the transaction id anymore. A replacement
+// conflicting with another one of the marker succeeds. A document overwritten by a write without
+// a cas, holding another value, fails with errOverwritten.
+func (c *CouchbaseStore) replaceMarker(id string, w txRecordWrite, want *rawValue, replace func(cas gocb.Cas) error) error {
+	cas := w.cas
+	if cas == 0 {
+		var marked bool
+		var err error
+		if cas, marked, err = c.markerCas(id, w.Key); err != nil {
+			return err
+		} else if !marked {
+			return c.replacedMarker(w.Key, want)
+		}
+	}
+
+	err := replace(cas)
+	if err == gocb.ErrKeyExists || err == gocb.ErrKeyNotFound {
+		if _, marked, err2 := c.markerCas(id, w.Key); err2 == nil && !marked {
+			return c.replacedMarker(w.Key, want)
+		}
+	}
+	return err
+}
+
+// replacedMarker checks the document at key, which isn't a marker anymore, holds want, or is
+// missing when want is nil. It fails with errOverwritten otherwise.
+func (c *CouchbaseStore) replacedMarker(key string, want *rawValue) error {
+	value := &rawValue{}
+	_, err := c.bucket.Get(key, value)
+	switch {
+	case err == gocb.ErrKeyNotFound:
+		if want == nil {
+			return nil
+		}
+	case err != nil:
+		return err
+	case want != nil && value.flags == want.flags && bytes.Equal(value.data, want.data):
+		return nil
+	}
+	return errOverwritten
+}
+
+// RecoverTransactions completes the transactions started more than olderThan ago, e.g. whose
+// client crashed: committed ones are applied and pending ones rolled back, restoring the
+// documents their markers stand for. olderThan must exceed the time transactions take to
+// commit, a minute is safe. The first error met is returned along with the number of
+// transactions completed.
+func (c *CouchbaseStore) RecoverTransactions(olderThan time.Duration) (int, error) {
+	recovered := 0
+	var failed error
+	fail := func(err error) {
+		if failed == nil {
+			failed = err
+		}
+	}
+	deadline := time.Now().Add(-olderThan)
+
+	after := ""
+	for {
+		keys, err := c.scanKeys(txRecordType, after, 100)
+		if err != nil {
+			return recovered, err
+		}
+
+		for _, key := range keys {
+			record := txRecord{}
+			d := c.txRecordDoc("", &record)
+			d.key = key
+			cas, err := c.bucket.Get(key, d)
+			if err == gocb.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				fail(makeGetError(err))
+				continue
+			}
+			if record.Started.After(deadline) {
+				continue
+			}
+
+			if record.State == txPending {
+				// The transaction is aborted first, so its client can't commit it anymore.
+				record.State = txAborted
+				if _, err := c.bucket.Replace(key, d, cas, 0); err == gocb.ErrKeyExists || err == gocb.ErrKeyNotFound {
+					continue
+				} else if err != nil {
+					fail(makeMutationError(err, cas))
+					continue
+				}
+			}
+
+			if record.State == txCommitted {
+				err = c.applyTransaction(key, d.GetId(), record)
+			} else {
+				err = c.rollbackTransaction(key, d.GetId(), record)
+			}
+			if err != nil {
+				fail(err)
+				continue
+			}
+			recovered++
+		}
+
+		if len(keys) < 100 {
+			return recovered, failed
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// staged reports whether meta is the meta of the marker of an inserted document.
+func staged(meta map[string]interface{}) bool {
+	inserted, _ := meta[txnInsert].(bool)
+	return inserted
+}
@@ -0,0 +1,347 @@
+package couchbase
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tlantic/go-nosql/database"
+	"github.com/couchbase/gocb"
+)
+
+type Wallet struct {
+	Balance int `json:"balance"`
+}
+
+// transfer moves amount from the wallet a to the wallet b, logging it under id.
+func transfer(store *CouchbaseStore, id string, amount int) func(tx *Tx) error {
+	return func(tx *Tx) error {
+		var a, b Wallet
+		from, to := tx.Get("wallet::a", &a), tx.Get("wallet::b", &b)
+		if from.IsFaulted() {
+			return from.Fault()
+		} else if to.IsFaulted() {
+			return to.Fault()
+		}
+		if a.Balance < amount {
+			return errors.New("insufficient funds")
+		}
+
+		a.Balance -= amount
+		b.Balance += amount
+		if err := tx.Replace(from); err != nil {
+			return err
+		}
+		if err := tx.Replace(to); err != nil {
+			return err
+		}
+
+		log := store.NewRow(id)
+		log.SetType("transfer")
+		log.SetData(map[string]interface{}{"amount": amount})
+		return tx.Insert(log)
+	}
+}
+
+func newWallets(t *testing.T) (*fakeBucket, *CouchbaseStore) {
+	fake := newFakeBucket()
+	fake.query = keyScan(fake)
+	store := newStore(fake)
+	wallets := NewRepository[Wallet](store)
+	if _, err := wallets.Insert("a", Wallet{Balance: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wallets.Insert("b", Wallet{Balance: 0}); err != nil {
+		t.Fatal(err)
+	}
+	return fake, store
+}
+
+func balances(t *testing.T, store *CouchbaseStore) (int, int) {
+	wallets := NewRepository[Wallet](store)
+	a, _, err := wallets.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := wallets.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.Balance, b.Balance
+}
+
+// crashingBucket fails the writes following the first replacement of a key matching after,
+// as if the client of a transaction crashed.
+type crashingBucket struct {
+	*fakeBucket
+	after   *regexp.Regexp
+	crashed bool
+}
+
+func (b *crashingBucket) Insert(key string, value interface{}, expiry uint32) (gocb.Cas, error) {
+	if b.crashed {
+		return 0, gocb.ErrTimeout
+	}
+	return b.fakeBucket.Insert(key, value, expiry)
+}
+func (b *crashingBucket) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	if b.crashed {
+		return 0, gocb.ErrTimeout
+	}
+	b.crashed = b.after != nil && b.after.MatchString(key)
+	return b.fakeBucket.Replace(key, value, cas, expiry)
+}
+func (b *crashingBucket) Remove(key string, cas gocb.Cas) (gocb.Cas, error) {
+	if b.crashed {
+		return 0, gocb.ErrTimeout
+	}
+	return b.fakeBucket.Remove(key, cas)
+}
+
+func TestCouchbaseStore_Transaction(t *testing.T) {
+	fake, store := newWallets(t)
+
+	if err := store.Transaction(transfer(store, "1", 30)); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := balances(t, store); a != 70 || b != 30 {
+		t.Errorf("Expected balances 70 and 30. got %d and %d.", a, b)
+	}
+	row := store.ReadOne("transfer::1")
+	if row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if row.GetMeta(TXN) == nil {
+		t.Error("Expected the document to be stamped with the transaction.")
+	}
+	for key, item := range fake.items {
+		if item.locked || regexp.MustCompile(`^_txn::`).MatchString(key) {
+			t.Errorf("Expected the transaction to be cleaned up. got %s.", key)
+		}
+	}
+
+	// Errors returned by fn discard the writes.
+	if err := store.Transaction(transfer(store, "2", 100)); err == nil || err.Error() != "insufficient funds" {
+		t.Errorf("Expected the error of fn. got %v.", err)
+	}
+	if err := store.Transaction(transfer(store, "1", 10)); err == nil {
+		t.Error("Expected inserting an existing document to fail the transaction.")
+	}
+	if a, b := balances(t, store); a != 70 || b != 30 {
+		t.Errorf("Expected the balances to be untouched. got %d and %d.", a, b)
+	}
+
+	// A concurrent write conflicts with the transaction, which runs again.
+	attempts := 0
+	err := store.Transaction(func(tx *Tx) error {
+		if attempts++; attempts == 1 {
+			var b Wallet
+			tx.Get("wallet::b", &b)
+			if _, err := NewRepository[Wallet](store).Upsert("b", Wallet{Balance: 50}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return transfer(store, "3", 20)(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := balances(t, store); attempts != 2 || a != 50 || b != 70 {
+		t.Errorf("Expected 2 attempts and balances 50 and 70. got %d, %d and %d.", attempts, a, b)
+	}
+}
+
+// overwritingBucket calls overwrite once the first record is replaced, committing its transaction.
+type overwritingBucket struct {
+	*fakeBucket
+	overwrite func()
+}
+
+func (b *overwritingBucket) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	cas, err := b.fakeBucket.Replace(key, value, cas, expiry)
+	if overwrite := b.overwrite; overwrite != nil && err == nil && strings.HasPrefix(key, txRecordType+"::") {
+		b.overwrite = nil
+		overwrite()
+	}
+	return cas, err
+}
+
+func TestCouchbaseStore_TransactionOverwritten(t *testing.T) {
+	fake, store := newWallets(t)
+
+	// A write without a cas overwrites a marker of the committed transaction, losing its write.
+	conn := &overwritingBucket{fakeBucket: fake, overwrite: func() {
+		if _, err := NewRepository[Wallet](store).Upsert("b", Wallet{Balance: 999}); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	err := newStore(conn).Transaction(transfer(store, "1", 30))
+	if !errors.Is(err, ErrTransactionIncomplete) {
+		t.Errorf("Expected ErrTransactionIncomplete. got %v.", err)
+	}
+	if a, b := balances(t, store); a != 70 || b != 999 {
+		t.Errorf("Expected balances 70 and 999. got %d and %d.", a, b)
+	}
+	for key := range fake.items {
+		if strings.HasPrefix(key, txRecordType+"::") {
+			t.Errorf("Expected the record to be removed. got %s.", key)
+		}
+	}
+}
+
+func TestCouchbaseStore_RecoverTransactions(t *testing.T) {
+	_, store := newWallets(t)
+
+	// The transaction fails once committed.
+	store.InjectFaults(NewFaultInjector(1, Fault{
+		Ops:  []Operation{OpReplace},
+		Keys: regexp.MustCompile(`^transfer::1$`),
+		Err:  gocb.ErrTimeout,
+	}))
+	if err := store.Transaction(transfer(store, "1", 30)); !errors.Is(err, ErrTransactionIncomplete) {
+		t.Fatalf("Expected ErrTransactionIncomplete. got %v.", err)
+	}
+	if row := store.ReadOne("transfer::1"); !row.IsFaulted() {
+		t.Error("Expected the placeholder of the insertion to be read as missing.")
+	} else if _, ok := row.Fault().(database.NotFoundError); !ok {
+		t.Errorf("Expected NotFoundError. got %v.", row.Fault())
+	}
+	store.InjectFaults(nil)
+
+	if n, err := store.RecoverTransactions(0); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Expected 1 transaction to be recovered. got %d.", n)
+	}
+	if a, b := balances(t, store); a != 70 || b != 30 {
+		t.Errorf("Expected balances 70 and 30. got %d and %d.", a, b)
+	}
+	if row := store.ReadOne("transfer::1"); row.IsFaulted() {
+		t.Error(row.Fault())
+	}
+	if n, err := store.RecoverTransactions(0); err != nil || n != 0 {
+		t.Errorf("Expected no transaction left. got %d and %v.", n, err)
+	}
+}
+
+func TestCouchbaseStore_TransactionSoftDelete(t *testing.T) {
+	fake, store := newWallets(t)
+	store.SetSoftDelete(&SoftDelete{})
+
+	if err := store.Transaction(func(tx *Tx) error {
+		return tx.Remove("wallet::b")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.items["wallet::b"]; !ok {
+		t.Fatal("Expected the document to be kept.")
+	}
+	if row := store.ReadOne("wallet::b"); !row.IsFaulted() {
+		t.Error("Expected the removed document to be soft-deleted.")
+	}
+
+	// Transactions see soft-deleted documents as missing, and insert over them.
+	err := store.Transaction(func(tx *Tx) error {
+		var b Wallet
+		if row := tx.Get("wallet::b", &b); !row.IsFaulted() {
+			t.Error("Expected the deleted document to be read as missing.")
+		}
+		if err := tx.Remove("wallet::b"); err == nil {
+			t.Error("Expected removing the deleted document to fail.")
+		} else if _, ok := err.(database.NotFoundError); !ok {
+			t.Errorf("Expected NotFoundError. got %v.", err)
+		}
+		row := store.NewRow("b")
+		row.SetType("wallet")
+		row.SetData(&Wallet{Balance: 10})
+		return tx.Insert(row)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := balances(t, store); a != 100 || b != 10 {
+		t.Errorf("Expected balances 100 and 10. got %d and %d.", a, b)
+	}
+}
+
+func TestCouchbaseStore_RecoverTransactionsCrash(t *testing.T) {
+	fake, store := newWallets(t)
+	before := store.ReadOne("wallet::b")
+
+	// The client crashes once the transaction is committed.
+	crashing := &crashingBucket{fakeBucket: fake, after: regexp.MustCompile(`^_txn::`)}
+	if err := newStore(crashing).Transaction(transfer(store, "1", 30)); !errors.Is(err, ErrTransactionIncomplete) {
+		t.Fatalf("Expected ErrTransactionIncomplete. got %v.", err)
+	}
+
+	// Concurrent writers can't change the documents of the transaction until it is recovered.
+	store.SetMutateAttempts(1)
+	if row := store.ReadOne("wallet::b"); !row.IsFaulted() {
+		t.Error("Expected the document to be read as locked.")
+	} else if _, ok := Cause(row.Fault()).(DocumentLockedError); !ok {
+		t.Errorf("Expected DocumentLockedError. got %v.", row.Fault())
+	}
+	if row := store.ReplaceOne(before); !row.IsFaulted() {
+		t.Error("Expected a write with the cas read before the transaction to fail.")
+	} else if _, ok := Cause(row.Fault()).(CASMismatchError); !ok {
+		t.Errorf("Expected CASMismatchError. got %v.", row.Fault())
+	}
+	if err := store.Transaction(transfer(store, "2", 10)); err == nil {
+		t.Error("Expected a concurrent transaction to fail.")
+	} else if _, ok := Cause(err).(DocumentLockedError); !ok {
+		t.Errorf("Expected DocumentLockedError. got %v.", err)
+	}
+
+	if n, err := store.RecoverTransactions(0); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Expected 1 transaction to be recovered. got %d.", n)
+	}
+	if a, b := balances(t, store); a != 70 || b != 30 {
+		t.Errorf("Expected balances 70 and 30. got %d and %d.", a, b)
+	}
+	if row := store.ReadOne("transfer::1"); row.IsFaulted() {
+		t.Error(row.Fault())
+	}
+}
+
+func TestCouchbaseStore_RecoverTransactionsRollback(t *testing.T) {
+	fake := newFakeBucket()
+	fake.query = keyScan(fake)
+	crashing := &crashingBucket{fakeBucket: fake}
+	store := newStore(crashing)
+	store.SetCodec(RawCodec{})
+	wallets := NewRepository[Wallet](store)
+	if _, err := wallets.Insert("a", Wallet{Balance: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wallets.Insert("b", Wallet{Balance: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client crashes before the transaction is committed.
+	crashing.after = regexp.MustCompile(`^wallet::a$`)
+	if err := store.Transaction(transfer(store, "1", 30)); err == nil {
+		t.Fatal("Expected the transaction to fail.")
+	}
+	crashing.after, crashing.crashed = nil, false
+
+	// Transactions started recently may still commit.
+	if n, err := store.RecoverTransactions(time.Minute); err != nil || n != 0 {
+		t.Errorf("Expected no transaction to be recovered. got %d and %v.", n, err)
+	}
+	if n, err := store.RecoverTransactions(0); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Expected 1 transaction to be rolled back. got %d.", n)
+	}
+	if a, b := balances(t, store); a != 100 || b != 0 {
+		t.Errorf("Expected balances 100 and 0. got %d and %d.", a, b)
+	}
+	for key, item := range fake.items {
+		if item.flags == flagsTxn || regexp.MustCompile(`^(_txn|transfer)::`).MatchString(key) {
+			t.Errorf("Expected the transaction to be rolled back. got %s.", key)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package couchbase
+
+import (
+	"fmt"
+
+	"github.com/couchbase/gocb"
+)
+
+// Assert interface implementation
+var (
+	_ gocb.Transcoder = transcoder{}
+	_ transcodable    = (*doc)(nil)
+	_ transcodable    = (*rawValue)(nil)
+)
+
+// CONTENTTYPE is the meta key holding the format of a document. Documents are JSON unless it
+// is set to ContentTypeBinary, storing a []byte as is, or ContentTypeString, storing a string.
+// Binary and string documents have no envelope: their id, type and metadata aren't stored.
+const CONTENTTYPE = "contentType"
+
+const (
+	ContentTypeJSON   = "application/json"
+	ContentTypeBinary = "application/octet-stream"
+	ContentTypeString = "text/plain"
+)
+
+// Common flags shared by the Couchbase SDKs to describe the format of a value.
+const (
+	flagsFormatMask uint32 = 0x0F000000
+	flagsJSON       uint32 = 2 << 24
+	flagsBinary     uint32 = 3 << 24
+	flagsString     uint32 = 4 << 24
+)
+
+// transcodable values choose the format they are stored with.
+type transcodable interface {
+	encode() ([]byte, uint32, error)
+	decode(data []byte, flags uint32) error
+}
+
+// transcoder lets documents set the flags they are stored with, so binary values aren't
+// wrapped in JSON. Other values are transcoded by gocb.
+type transcoder struct {
+	gocb.DefaultTranscoder
+}
+
+func (t transcoder) Encode(value interface{}) ([]byte, uint32, error) {
+	if v, ok := value.(transcodable); ok {
+		return v.encode()
+	}
+	return t.DefaultTranscoder.Encode(value)
+}
+
+func (t transcoder) Decode(data []byte, flags uint32, out interface{}) error {
+	if v, ok := out.(transcodable); ok {
+		return v.decode(data, flags)
+	}
+	return t.DefaultTranscoder.Decode(data, flags, out)
+}
+
+func (doc *doc) encode() ([]byte, uint32, error) {
+	switch doc.GetMeta(CONTENTTYPE) {
+	case ContentTypeBinary:
+		switch value := doc.Data.(type) {
+		case []byte:
+			return value, flagsBinary, nil
+		case *[]byte:
+			return *value, flagsBinary, nil
+		}
+		return nil, 0, fmt.Errorf("couchbase: binary documents hold []byte, got %T", doc.Data)
+	case ContentTypeString:
+		switch value := doc.Data.(type) {
+		case string:
+			return []byte(value), flagsString, nil
+		case *string:
+			return []byte(*value), flagsString, nil
+		}
+		return nil, 0, fmt.Errorf("couchbase: string documents hold string, got %T", doc.Data)
+	}
+
+	data, err := doc.MarshalJSON()
+	return data, flagsJSON, err
+}
+
+func (doc *doc) decode(data []byte, flags uint32) error {
+	if flags&flagsFormatMask == flagsBinary || flags&flagsFormatMask == flagsString {
+		if !doc.owned(nil) {
+			return errOtherTenant
+		}
+	}
+
+	switch flags & flagsFormatMask {
+	case flagsTxn:
+		return markerError(data)
+	case flagsBinary:
+		if out, ok := doc.Data.(*[]byte); ok {
+			*out = append([]byte(nil), data...)
+		} else {
+			doc.Data = append([]byte(nil), data...)
+		}
+		doc.Meta = map[string]interface{}{CONTENTTYPE: ContentTypeBinary}
+	case flagsString:
+		if out, ok := doc.Data.(*string); ok {
+			*out = string(data)
+		} else {
+			doc.Data = string(data)
+		}
+		doc.Meta = map[string]interface{}{CONTENTTYPE: ContentTypeString}
+	default:
+		return doc.UnmarshalJSON(data)
+	}
+	return nil
+}
+
+// rawValue captures a value as stored, along with its flags.
+type rawValue struct {
+	data  []byte
+	flags uint32
+}
+
+func (v *rawValue) encode() ([]byte, uint32, error) {
+	return v.data, v.flags, nil
+}
+
+func (v *rawValue) decode(data []byte, flags uint32) error {
+	v.data = append([]byte(nil), data...)
+	v.flags = flags
+	return nil
+}
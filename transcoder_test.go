@@ -0,0 +1,93 @@
+package couchbase
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCouchbaseStore_Binary(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+	store.Instrument(NewMetrics("test"))
+
+	blob := []byte{0x89, 'P', 'N', 'G', 0x00}
+	d := store.NewRow("logo")
+	d.SetType("image")
+	d.SetMeta(CONTENTTYPE, ContentTypeBinary)
+	d.SetData(blob)
+	s := store.NewRow("motd")
+	s.SetType("text")
+	s.SetMeta(CONTENTTYPE, ContentTypeString)
+	s.SetData("hello")
+	if rows, ok := store.Create(d, s); !ok {
+		t.Fatal(_firstFault(rows))
+	}
+
+	if item := fake.items["image::logo"]; !bytes.Equal(item.value, blob) || item.flags != flagsBinary {
+		t.Errorf("Expected the blob to be stored as is. got %q with flags %x.", item.value, item.flags)
+	}
+	if item := fake.items["text::motd"]; string(item.value) != "hello" || item.flags != flagsString {
+		t.Errorf("Expected the string to be stored as is. got %q with flags %x.", item.value, item.flags)
+	}
+
+	row := store.ReadOne("image::logo")
+	if row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	if data, ok := row.GetData().([]byte); !ok || !bytes.Equal(data, blob) {
+		t.Errorf("Expected the blob. got %v.", row.GetData())
+	}
+	if row.GetMeta(CONTENTTYPE) != ContentTypeBinary {
+		t.Errorf("Expected content type %s. got %v.", ContentTypeBinary, row.GetMeta(CONTENTTYPE))
+	}
+
+	var text string
+	if row := store.ReadOneWithType("text::motd", &text); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if text != "hello" {
+		t.Errorf("Expected hello. got %q.", text)
+	}
+
+	d = store.NewRow("bad")
+	d.SetMeta(CONTENTTYPE, ContentTypeBinary)
+	d.SetData(&User{})
+	if row := store.CreateOne(d); !row.IsFaulted() {
+		t.Error("Expected binary documents holding structs to fault.")
+	}
+}
+
+func TestRecorder_ReplayBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "couchbase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	golden := filepath.Join(dir, "session.json")
+
+	fake := newFakeBucket()
+	store := newStore(&recorder{bucket: fake, path: golden})
+
+	d := store.NewRow("logo")
+	d.SetMeta(CONTENTTYPE, ContentTypeBinary)
+	d.SetData([]byte{0x00, 0xff})
+	if row := store.CreateOne(d); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+	store.ReadOne(d.GetKey())
+	store.Close()
+
+	if store, err = NewReplayStore(golden); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.CreateOne(d)
+	if row := store.ReadOne(d.GetKey()); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	} else if data, ok := row.GetData().([]byte); !ok || !bytes.Equal(data, []byte{0x00, 0xff}) {
+		t.Errorf("Expected the blob to be replayed. got %v.", row.GetData())
+	}
+}
@@ -3,8 +3,22 @@ package couchbase
 import (
 	"github.com/couchbase/gocb"
 	"strconv"
+	"time"
 )
 
+// maxRelativeExpiry is the longest expiry the server reads as relative to now. Longer ones are
+// read as Unix times.
+const maxRelativeExpiry = 30 * 24 * time.Hour
+
+// makeExpiry converts ttl to the expiry of a document, rounding up to the second. TTLs longer
+// than maxRelativeExpiry are converted to the Unix time they end at.
+func makeExpiry(ttl time.Duration) uint32 {
+	if ttl > maxRelativeExpiry {
+		return uint32(time.Now().Add(ttl + time.Second - 1).Unix())
+	}
+	return uint32((ttl + time.Second - 1) / time.Second)
+}
+
 func makeInt64(i interface{}) (v int64) {
 	switch n := i.(type) {
 	case uint8:
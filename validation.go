@@ -0,0 +1,186 @@
+package couchbase
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+// Validator is implemented by data validating itself before it is written.
+type Validator interface {
+	Validate() error
+}
+
+// ValidationError reports a field of the data failing one of its rules.
+type ValidationError struct {
+	Field string
+	Rule  string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("couchbase: field %s fails rule %s", e.Field, e.Rule)
+}
+
+// rule checks a field, reporting whether it is valid.
+type rule struct {
+	name  string
+	check func(v reflect.Value) bool
+}
+
+type fieldRules struct {
+	index int
+	name  string
+	rules []rule
+}
+
+// validations caches the rules of the struct types, parsed from their cbvalidate tags.
+var validations sync.Map
+
+// Validate checks data before it is written. Data implementing Validator validates itself, then
+// the top-level fields of structs are checked against their `cbvalidate` tags: a comma separated
+// list of the rules required, min=n and max=n, bounding numbers or the length of strings, slices
+// and maps, and regex=expr, matching strings. The regex rule must come last.
+func Validate(data interface{}) error {
+	if v, ok := data.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields, err := rulesOf(v.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		for _, r := range f.rules {
+			if !r.check(v.Field(f.index)) {
+				return ValidationError{Field: f.name, Rule: r.name}
+			}
+		}
+	}
+	return nil
+}
+
+func rulesOf(t reflect.Type) ([]fieldRules, error) {
+	if fields, ok := validations.Load(t); ok {
+		return fields.([]fieldRules), nil
+	}
+
+	var fields []fieldRules
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("cbvalidate")
+		if tag == "" || f.PkgPath != "" {
+			continue
+		}
+		rules, err := parseRules(f.Type, tag)
+		if err != nil {
+			return nil, fmt.Errorf("couchbase: field %s of %s: %v", f.Name, t, err)
+		}
+		fields = append(fields, fieldRules{index: i, name: f.Name, rules: rules})
+	}
+	validations.Store(t, fields)
+	return fields, nil
+}
+
+func parseRules(t reflect.Type, tag string) ([]rule, error) {
+	var rules []rule
+	for tag != "" {
+		var spec string
+		if strings.HasPrefix(tag, "regex=") {
+			spec, tag = tag, ""
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			spec, tag = tag[:i], tag[i+1:]
+		} else {
+			spec, tag = tag, ""
+		}
+
+		name, arg := spec, ""
+		if i := strings.IndexByte(spec, '='); i >= 0 {
+			name, arg = spec[:i], spec[i+1:]
+		}
+
+		switch name {
+		case "required":
+			rules = append(rules, rule{spec, func(v reflect.Value) bool { return !v.IsZero() }})
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %s: %v", spec, err)
+			}
+			if _, ok := measure(reflect.Zero(t)); !ok {
+				return nil, fmt.Errorf("rule %s doesn't apply to %s", spec, t)
+			}
+			min := name == "min"
+			rules = append(rules, rule{spec, func(v reflect.Value) bool {
+				n, _ := measure(v)
+				if min {
+					return n >= bound
+				}
+				return n <= bound
+			}})
+		case "regex":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %s: %v", spec, err)
+			}
+			if t.Kind() != reflect.String {
+				return nil, fmt.Errorf("rule %s doesn't apply to %s", spec, t)
+			}
+			rules = append(rules, rule{spec, func(v reflect.Value) bool { return re.MatchString(v.String()) }})
+		default:
+			return nil, fmt.Errorf("unknown rule %s", spec)
+		}
+	}
+	return rules, nil
+}
+
+// measure returns the value of numbers and the length of strings, slices and maps.
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true
+	}
+	return 0, false
+}
+
+// SetValidator checks the data of the documents written by the store with validate, such as
+// Validate. Rows whose data fails are faulted with InvalidArgsError and aren't sent. Documents
+// created from a string or Stringer key hold no data and are never validated. Validation is off
+// until a validator is set; passing nil turns it off again.
+func (c *CouchbaseStore) SetValidator(validate func(data interface{}) error) {
+	c.validator = validate
+}
+
+// validate checks the data of doc before it is written.
+func (c *CouchbaseStore) validate(doc *doc) error {
+	if doc.Data == nil || c.validator == nil {
+		return nil
+	}
+	if err := c.validator(doc.Data); err != nil {
+		return database.InvalidArgsError{err}
+	}
+	return nil
+}
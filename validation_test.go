@@ -0,0 +1,102 @@
+package couchbase
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Tlantic/go-nosql/database"
+)
+
+type Account struct {
+	Username string   `json:"username" cbvalidate:"required,min=3,max=12,regex=^[a-z0-9_]+$"`
+	Age      int      `json:"age" cbvalidate:"min=18"`
+	Roles    []string `json:"roles" cbvalidate:"max=2"`
+}
+
+func (a *Account) Validate() error {
+	if a.Username == "root" {
+		return errors.New("reserved username")
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		data interface{}
+		rule string
+	}{
+		{&Account{Username: "username", Age: 18}, ""},
+		{&Account{Age: 18}, "required"},
+		{&Account{Username: "ab", Age: 18}, "min=3"},
+		{&Account{Username: "UserName", Age: 18}, "regex=^[a-z0-9_]+$"},
+		{&Account{Username: "username", Age: 17}, "min=18"},
+		{&Account{Username: "username", Age: 18, Roles: []string{"a", "b", "c"}}, "max=2"},
+		{&User{}, ""},
+		{"string", ""},
+	} {
+		rule := ""
+		if err := Validate(tt.data); err != nil {
+			rule = err.(ValidationError).Rule
+		}
+		if rule != tt.rule {
+			t.Errorf("Expected %+v to fail %q. got %q.", tt.data, tt.rule, rule)
+		}
+	}
+
+	if err := Validate(&Account{Username: "root", Age: 18}); err == nil || err.Error() != "reserved username" {
+		t.Errorf("Expected the Validate method to run. got %v.", err)
+	}
+
+	type invalid struct {
+		Name string `cbvalidate:"between=1"`
+	}
+	if err := Validate(&invalid{}); err == nil {
+		t.Error("Expected unknown rules to fail.")
+	}
+}
+
+func TestCouchbaseStore_Validation(t *testing.T) {
+	fake := newFakeBucket()
+	store := newStore(fake)
+
+	valid := store.NewRow("1")
+	valid.SetType("account")
+	valid.SetData(&Account{Username: "username", Age: 30})
+	invalid := store.NewRow("2")
+	invalid.SetType("account")
+	invalid.SetData(&Account{Username: "username", Age: 12})
+
+	// Validation is opt-in.
+	if row := store.ReplaceOne(invalid); row.IsFaulted() {
+		if _, isInvalid := row.Fault().(database.InvalidArgsError); isInvalid {
+			t.Error("Expected no validation until a validator is set.")
+		}
+	}
+
+	store.SetValidator(Validate)
+	rows, ok := store.Create(valid, invalid)
+	if ok {
+		t.Error("Expected the batch to fail.")
+	}
+	if rows[0].IsFaulted() {
+		t.Fatal(rows[0].Fault())
+	}
+	if _, isInvalid := rows[1].Fault().(database.InvalidArgsError); !isInvalid {
+		t.Errorf("Expected InvalidArgsError. got %v.", rows[1].Fault())
+	}
+	if _, sent := fake.items["account::2"]; sent {
+		t.Error("Expected the invalid row not to be sent.")
+	}
+
+	if row := store.ReplaceOne(invalid); !row.IsFaulted() {
+		t.Error("Expected ReplaceOne to validate.")
+	}
+	if rows, _ := store.Upsert(invalid); !rows[0].IsFaulted() {
+		t.Error("Expected Upsert to validate.")
+	}
+
+	store.SetValidator(nil)
+	if row := store.CreateOne(invalid); row.IsFaulted() {
+		t.Fatal(row.Fault())
+	}
+}